@@ -0,0 +1,320 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Action is a one-click action reachable through a payload link.
+type Action struct {
+	// payload action the link must be minted for
+	Name string
+
+	// template shown on GET, empty means GET submits the action right away
+	FormTemplate string
+	Form         Form
+	// override Form by report type claim of payload
+	Questionnaires Questionnaires
+
+	Callback Callback
+
+	// rendered on success when callback result has no body or message
+	DoneTemplate string
+	// rendered when the link is already processed
+	ProcessedTemplate string
+}
+
+func (a Action) submitsOnGet() bool {
+	return a.FormTemplate == ""
+}
+
+func (a Action) formFor(payload Payload) Form {
+	if form, ok := a.Questionnaires.For(payload.Claim(ClaimReportType)); ok {
+		return form
+	}
+	return a.Form
+}
+
+func (s Server) templates() *Templates {
+	if s.Templates == nil {
+		return DefaultTemplates()
+	}
+	return s.Templates
+}
+
+// render template with payload, empty name renders nothing
+func (s Server) renderPage(name string, data PageData) string {
+	if name == "" {
+		return ""
+	}
+
+	page, err := s.templates().Render(name, data)
+	if err != nil {
+		s.logger().With(Fields{"template": name}).Error("Cannot render template", Fields{"error": err})
+	}
+	return page
+}
+
+func (s Server) writePage(w http.ResponseWriter, status int, page string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(page))
+}
+
+// take payload from the last part of url path, or the part before
+// "/status" of "/token/{payload}/status"
+func requestToken(r *http.Request) string {
+	urlPart := strings.Split(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/status"), "/")
+	return urlPart[len(urlPart) - 1]
+}
+
+// payload or error decoded by rate limit middleware is reused
+func (s Server) decodeRequestPayload(r *http.Request) (Payload, error) {
+	if decoded, ok := r.Context().Value(payloadContextKey{}).(decodedPayload); ok {
+		return decoded.Payload, decoded.Err
+	}
+	return s.Keyring.DecodePayload(requestToken(r))
+}
+
+// reply to a refNo claimed before, false when it is new or failed and can
+// be claimed
+func (s Server) replyClaimed(w http.ResponseWriter, r *http.Request, logger Entry, action Action, payload Payload, locale string, state string) bool {
+	switch state {
+	case "", RefNoFailed:
+		return false
+	case RefNoCommitted:
+		logger.Info("Payload is already processed")
+		s.reply(w, r, http.StatusOK,
+			APIResponse{Status: StatusAlreadyProcessed, Message: MessageIn(locale, MessageProcessed)},
+			s.renderPage(action.ProcessedTemplate, PageData{Payload: payload, Locale: locale}))
+	case RefNoPending:
+		logger.Info("Payload is being processed")
+		message := MessageIn(locale, MessagePending)
+		s.reply(w, r, http.StatusConflict, APIResponse{Status: StatusPending, Message: message, Retryable: true}, message)
+	case RefNoRejected:
+		logger.Info("Payload is rejected")
+		message := MessageIn(locale, MessageRejected)
+		s.reply(w, r, http.StatusGone, APIResponse{Status: StatusRejected, Message: message}, message)
+	default:
+		// no retry helps until the refNo expires
+		logger.Error("Unknown refNo state", Fields{"state": state})
+		s.reply(w, r, http.StatusInternalServerError, APIResponse{Status: StatusError}, "")
+	}
+	return true
+}
+
+// answer a submit without valid csrf token with a fresh token, a form page
+// keeps the submitted answers so the user only has to submit again
+func (s Server) rejectCSRF(w http.ResponseWriter, r *http.Request, action Action, payload Payload, locale string, values url.Values) {
+	message := MessageIn(locale, MessageInvalidCSRF)
+	csrf := s.csrfToken(payload)
+
+	page := message
+	if payload.IsExpired() {
+		page = s.renderPage(TemplateExpired, PageData{Payload: payload, Locale: locale, Message: message, Reissuable: s.canReissue(payload), CSRF: csrf})
+	} else if !action.submitsOnGet() {
+		form := action.formFor(payload)
+		page = s.renderPage(action.FormTemplate, PageData{
+			Payload: payload,
+			Form: form,
+			Values: form.filter(values),
+			Locale: locale,
+			Message: message,
+			CSRF: csrf,
+		})
+	}
+
+	s.reply(w, r, http.StatusForbidden, APIResponse{Status: StatusInvalidCSRF, Message: message, CSRF: csrf}, page)
+}
+
+func (s Server) ActionHandler(action Action) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.setCORS(w, r) {
+			return
+		}
+
+		r = withRequestId(w, r)
+		logger := s.requestLog(r).With(Fields{"action": action.Name})
+
+		aw := &auditWriter{ResponseWriter: w, record: AuditRecord{Time: time.Now(), RequestId: RequestId(r), Action: action.Name}}
+		w = aw
+		defer func() {
+			s.metrics().HandlerResponses.WithLabelValues(action.Name, aw.record.Outcome).Inc()
+			s.metrics().HandlerDuration.WithLabelValues(action.Name).Observe(time.Since(aw.record.Time).Seconds())
+
+			// a submit is audited, viewing the form is not
+			if r.Method != "GET" || action.submitsOnGet() {
+				s.audit(r, aw)
+			}
+		}()
+
+		payload, err := s.decodeRequestPayload(r)
+		if err != nil {
+			logger.Warn("Cannot decode payload", Fields{"error": err})
+			s.reply(w, r, http.StatusBadRequest, APIResponse{Status: StatusInvalidToken}, "")
+			return
+		}
+
+		aw.setPayload(payload)
+		logger = logger.With(Fields{"reportId": payload.Id, "refNo": payload.RefNo})
+		locale := RequestLocale(payload, r)
+
+		if !payload.IsFor(action.Name) {
+			logger.Warn("Payload is minted for another action", Fields{"payloadAction": payload.Action})
+			message := MessageIn(locale, MessageWrongAction)
+			s.reply(w, r, http.StatusForbidden, APIResponse{Status: StatusWrongAction, Message: message}, message)
+			return
+		}
+
+		// submitted values, nothing is done with them before forgery checks
+		var values url.Values
+		if r.Method != "GET" {
+			if !s.allowsOrigin(r) {
+				logger.Warn("Submit from other origin rejected", Fields{"origin": r.Header.Get("Origin")})
+				message := MessageIn(locale, MessageForbiddenOrigin)
+				s.reply(w, r, http.StatusForbidden, APIResponse{Status: StatusForbiddenOrigin, Message: message}, message)
+				return
+			}
+
+			values, err = parseRequestValues(w, r)
+			if err != nil {
+				logger.Warn("Cannot parse submit", Fields{"error": err})
+				s.reply(w, r, http.StatusBadRequest, APIResponse{Status: StatusInvalidRequest}, "")
+				return
+			}
+
+			if err := s.CheckCSRFToken(payload.RefNo, values.Get(CSRFField)); err != nil {
+				logger.Warn("Submit without valid csrf token rejected", Fields{"error": err})
+				s.rejectCSRF(w, r, action, payload, locale, values)
+				return
+			}
+		}
+
+		// expire
+		if payload.IsExpired() {
+			logger.Info("Payload is expired")
+
+			// an answered link stays answered, a fresh link of it would
+			// answer the report twice
+			state, err := s.Cache.Get(payload.RefNo)
+			if err != nil {
+				logger.Error("Cannot get refNo", Fields{"error": err})
+				s.reply(w, r, http.StatusInternalServerError, APIResponse{Status: StatusError, Retryable: true}, "")
+				return
+			}
+			if s.replyClaimed(w, r, logger, action, payload, locale, state) {
+				return
+			}
+
+			if values.Get("reissue") != "" {
+				s.reissue(w, r, payload, locale)
+				return
+			}
+
+			reissuable := s.canReissue(payload)
+			csrf := ""
+			if reissuable {
+				csrf = s.csrfToken(payload)
+			}
+			s.reply(w, r, http.StatusBadRequest,
+				APIResponse{Status: StatusExpired, Message: MessageIn(locale, MessageExpired), CSRF: csrf},
+				s.renderPage(TemplateExpired, PageData{Payload: payload, Locale: locale, Reissuable: reissuable, CSRF: csrf}))
+			return
+		}
+
+		if r.Method == "GET" && !action.submitsOnGet() {
+			if state, _ := s.Cache.Get(payload.RefNo); state == RefNoCommitted {
+				s.reply(w, r, http.StatusOK,
+					APIResponse{Status: StatusAlreadyProcessed, Message: MessageIn(locale, MessageProcessed)},
+					s.renderPage(action.ProcessedTemplate, PageData{Payload: payload, Locale: locale}))
+			} else {
+				form := action.formFor(payload)
+				csrf := s.csrfToken(payload)
+				s.reply(w, r, http.StatusOK,
+					APIResponse{Status: StatusOK, Form: &form, CSRF: csrf},
+					s.renderPage(action.FormTemplate, PageData{Payload: payload, Form: form, Locale: locale, CSRF: csrf}))
+			}
+			return
+		}
+
+		if r.Method != "GET" {
+			form := action.formFor(payload)
+			payload.Form = form.filter(values)
+			setAnswers(w, payload.Form)
+
+			// refNo stays unclaimed until a valid submit
+			answers, errors := form.Parse(values)
+			if len(errors) > 0 {
+				logger.Info("Invalid submit", Fields{"errors": errors})
+				page := MessageIn(locale, MessageInvalidForm)
+				csrf := s.csrfToken(payload)
+				if !action.submitsOnGet() {
+					page = s.renderPage(action.FormTemplate, PageData{
+						Payload: payload,
+						Form: form,
+						Errors: errors,
+						Values: payload.Form,
+						Locale: locale,
+						CSRF: csrf,
+					})
+				}
+
+				fieldErrors := make(map[string]string)
+				for name, key := range errors {
+					fieldErrors[name] = MessageIn(locale, key)
+				}
+				s.reply(w, r, http.StatusBadRequest, APIResponse{
+					Status: StatusValidationErrors,
+					Message: MessageIn(locale, MessageInvalidForm),
+					Errors: fieldErrors,
+					CSRF: csrf,
+				}, page)
+				return
+			}
+			payload.Answers = answers
+		}
+
+		// refno
+		state, err := s.claimRefNo(payload)
+		if err != nil {
+			logger.Error("Cannot claim refNo", Fields{"error": err})
+			s.reply(w, r, http.StatusInternalServerError, APIResponse{Status: StatusError, Retryable: true}, "")
+			return
+		}
+		if s.replyClaimed(w, r, logger, action, payload, locale, state) {
+			return
+		}
+		logger.Debug("Payload is a new one")
+
+		result := Result{}
+		if action.Callback != nil {
+			start := time.Now()
+			result = action.Callback.Execute(payload)
+			s.metrics().CallbackDuration.WithLabelValues(action.Name, resultLabel(result)).Observe(time.Since(start).Seconds())
+		}
+
+		if result.Success() {
+			s.commitRefNo(payload)
+			response := APIResponse{Status: StatusOK}
+			if result.MessageKey != "" {
+				response.Message = MessageIn(locale, result.MessageKey)
+			}
+			s.reply(w, r, result.StatusCode(), response,
+				result.Render(locale, s.renderPage(action.DoneTemplate, PageData{Payload: payload, Locale: locale})))
+			return
+		}
+
+		logger.Error("Callback failed", Fields{"retryable": result.Retryable, "error": result.Err})
+		s.failRefNo(payload, result.Retryable)
+		response := APIResponse{Status: StatusError, Message: MessageIn(locale, MessageTryAgain), Retryable: result.Retryable}
+		if !result.Retryable {
+			response.Status = StatusRejected
+		}
+		if result.MessageKey != "" {
+			response.Message = MessageIn(locale, result.MessageKey)
+		}
+		s.reply(w, r, result.StatusCode(), response, result.Render(locale, MessageIn(locale, MessageTryAgain)))
+	}
+}
@@ -0,0 +1,82 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type RecordingCallback struct {
+	Payloads *[]Payload
+}
+
+func (c RecordingCallback) Execute(payload Payload) Result {
+	*c.Payloads = append(*c.Payloads, payload)
+	return Result{}
+}
+
+func TestActionHandler(t *testing.T) {
+	templates := DefaultTemplates()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+		Templates: templates,
+	}
+
+	var payloads []Payload
+	action := Action{
+		Name: "recovered",
+		FormTemplate: TemplateQuestionnaire,
+		Form: Form{
+			Fields: []FormField{{Name: "animalCount", Type: FieldNumber, Required: true}},
+		},
+		Callback: RecordingCallback{Payloads: &payloads},
+		DoneTemplate: TemplateVerifyDone,
+		ProcessedTemplate: TemplateProcessed,
+	}
+	handler := http.HandlerFunc(server.ActionHandler(action))
+
+	payload, _ := CreatePayload("recovered", "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	donePage, _ := templates.Render(TemplateVerifyDone, PageData{Payload: payload})
+	processedPage, _ := templates.Render(TemplateProcessed, PageData{Payload: payload})
+
+	req, _ := http.NewRequest("GET", "/report/recovered/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `name="animalCount"`) || len(payloads) != 0 {
+		t.Fatalf("GET must render form page without executing callback, got %q", rr.Body.String())
+	}
+
+	form := url.Values{"animalCount": {"3"}, "unknown": {"1"}, CSRFField: {csrfToken(server, payload)}}.Encode()
+	req, _ = http.NewRequest("POST", "/report/recovered/" + payloadStr, strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != donePage {
+		t.Fatalf("handler returned %v %q, want %v %q", rr.Code, rr.Body.String(), http.StatusOK, donePage)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("callback executed %d times, want 1", len(payloads))
+	}
+	if payloads[0].Form.Get("animalCount") != "3" || payloads[0].Form.Get("unknown") != "" {
+		t.Errorf("callback must receive declared form fields only, got %v", payloads[0].Form)
+	}
+	if answer, _ := payloads[0].Answers.Get("animalCount"); answer.Number != 3 {
+		t.Errorf("callback must receive typed answers, got %v", payloads[0].Answers)
+	}
+
+	req, _ = http.NewRequest("GET", "/report/recovered/" + payloadStr, nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Body.String() != processedPage {
+		t.Errorf("GET of processed link must render processed page, got %q", rr.Body.String())
+	}
+}
@@ -0,0 +1,138 @@
+package podd_service_notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// status of APIResponse
+const (
+	StatusOK               = "ok"
+	StatusExpired          = "expired"
+	StatusAlreadyProcessed = "already_processed"
+	StatusInvalidToken     = "invalid_token"
+	StatusValidationErrors = "validation_errors"
+	StatusInvalidRequest   = "invalid_request"
+	StatusWrongAction      = "wrong_action"
+	StatusPending          = "pending"
+	StatusRejected         = "rejected"
+	StatusError            = "error"
+	StatusReissued         = "reissued"
+	StatusReportClosed     = "report_closed"
+	StatusRateLimited      = "rate_limited"
+	StatusForbiddenOrigin  = "forbidden_origin"
+	StatusInvalidCSRF      = "invalid_csrf"
+)
+
+// JSON body of action handlers when the client accepts application/json
+type APIResponse struct {
+	Status string `json:"status"`
+	// localized message to show the user
+	Message string `json:"message,omitempty"`
+	// localized error messages by field name
+	Errors map[string]string `json:"errors,omitempty"`
+	// questions to answer on submit, set on GET of an action with a form
+	Form *Form `json:"form,omitempty"`
+	// the user may submit the same link again
+	Retryable bool `json:"retryable,omitempty"`
+	// token to send back as CSRFField on the next submit
+	CSRF string `json:"csrf,omitempty"`
+}
+
+// return true when request accepts application/json, html stays the default
+// for webviews which send */*
+func WantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSONBody(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// convert a JSON object of answers to form values, a value is a string,
+// number, boolean or an array of those
+func parseJSONValues(r *http.Request) (url.Values, error) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	for name, v := range body {
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+
+		for _, item := range items {
+			s, err := jsonValueString(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			values.Add(name, s)
+		}
+	}
+	return values, nil
+}
+
+func jsonValueString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// answers of a form are small, a larger body is refused before decoding
+const maxRequestBody = 64 << 10
+
+// submitted values of json or form encoded body
+func parseRequestValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	if isJSONBody(r) {
+		return parseJSONValues(r)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	return r.Form, nil
+}
+
+func (s Server) writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// write response as json or page by Accept header of request
+func (s Server) reply(w http.ResponseWriter, r *http.Request, status int, response APIResponse, page string) {
+	w.Header().Add("Vary", "Accept")
+	setOutcome(w, response.Status)
+	if WantsJSON(r) {
+		s.writeJSON(w, status, response)
+		return
+	}
+	s.writePage(w, status, page)
+}
@@ -0,0 +1,104 @@
+package podd_service_notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveJSON(handler http.Handler, method string, url string, body string) (int, APIResponse) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Accept", "application/json")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var response APIResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr.Code, response
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := map[string]bool{
+		"": false,
+		"*/*": false,
+		"text/html,application/xhtml+xml,*/*;q=0.8": false,
+		"application/json": true,
+		"text/plain, application/json; charset=utf-8": true,
+	}
+
+	for accept, want := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		if got := WantsJSON(req); got != want {
+			t.Errorf("Accept %q: got %t want %t", accept, got, want)
+		}
+	}
+}
+
+func TestVerifyReportHandlerJSON(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+	}
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+
+	status, response := serveJSON(handler, "GET", "/report/verify/nothex", "")
+	if status != http.StatusBadRequest || response.Status != StatusInvalidToken {
+		t.Errorf("bad token: got %d %q", status, response.Status)
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	url := "/report/verify/" + payloadStr
+
+	status, response = serveJSON(handler, "GET", url, "")
+	if status != http.StatusOK || response.Status != StatusOK || response.Form == nil || len(response.Form.Fields) != len(DefaultVerifyForm.Fields) {
+		t.Errorf("GET must return the form to answer, got %d %+v", status, response)
+	}
+	csrf := `"csrf": "` + response.CSRF + `", `
+
+	status, response = serveJSON(handler, "POST", url, `{` + csrf + `"isOutbreak": true}`)
+	if status != http.StatusBadRequest || response.Status != StatusValidationErrors || response.Errors["isVerified"] == "" {
+		t.Errorf("missing answer must be a validation error, got %d %+v", status, response)
+	}
+
+	status, response = serveJSON(handler, "POST", url, `{` + csrf + `"isVerified": 1, "isOutbreak": ["0"]}`)
+	if status != http.StatusOK || response.Status != StatusOK || atomic.LoadInt32(&count) != 1 {
+		t.Errorf("valid answers must be submitted, got %d %+v", status, response)
+	}
+
+	status, response = serveJSON(handler, "POST", url, `{` + csrf + `"isVerified": 1, "isOutbreak": 0}`)
+	if status != http.StatusOK || response.Status != StatusAlreadyProcessed || atomic.LoadInt32(&count) != 1 {
+		t.Errorf("second submit must be already processed, got %d %+v", status, response)
+	}
+
+	expired, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -time.Second)
+	expiredStr, _ := server.Keyring.EncodePayload(expired)
+	status, response = serveJSON(handler, "GET", "/report/verify/" + expiredStr, "")
+	if status != http.StatusBadRequest || response.Status != StatusExpired {
+		t.Errorf("expired token: got %d %q", status, response.Status)
+	}
+
+	other, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	otherStr, _ := server.Keyring.EncodePayload(other)
+	status, response = serveJSON(handler, "POST", "/report/verify/" + otherStr, `{"isVerified": {}}`)
+	if status != http.StatusBadRequest || response.Status != StatusInvalidRequest {
+		t.Errorf("unsupported answer value: got %d %q", status, response.Status)
+	}
+
+	status, response = serveJSON(handler, "POST", "/report/verify/" + otherStr, `{"isOutbreak": "` + strings.Repeat("1", maxRequestBody) + `"}`)
+	if status != http.StatusBadRequest || response.Status != StatusInvalidRequest {
+		t.Errorf("oversized body: got %d %q", status, response.Status)
+	}
+}
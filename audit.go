@@ -0,0 +1,83 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// AuditRecord is one attempt at an action link.
+type AuditRecord struct {
+	Time      time.Time
+	RequestId string
+
+	// sha256 prefix of the user token, the same as in cache keys
+	UserHash string
+	ReportId int
+	Action   string
+	RefNo    string
+
+	// status of APIResponse, e.g. ok, already_processed or validation_errors
+	Outcome    string
+	StatusCode int
+	// submitted answers of the action form
+	Answers url.Values
+	Latency time.Duration
+}
+
+type AuditSink interface {
+	Record(record AuditRecord) error
+}
+
+// auditWriter collects the record while an action handler runs
+type auditWriter struct {
+	http.ResponseWriter
+	record AuditRecord
+}
+
+func (a *auditWriter) WriteHeader(status int) {
+	a.record.StatusCode = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditWriter) setPayload(payload Payload) {
+	a.record.UserHash = userKey(payload)
+	a.record.ReportId = payload.Id
+	a.record.RefNo = payload.RefNo
+}
+
+// set outcome when w collects an audit record
+func setOutcome(w http.ResponseWriter, outcome string) {
+	if a, ok := w.(*auditWriter); ok {
+		a.record.Outcome = outcome
+	}
+}
+
+func setAnswers(w http.ResponseWriter, answers url.Values) {
+	if a, ok := w.(*auditWriter); ok {
+		a.record.Answers = answers
+	}
+}
+
+func (s Server) audit(r *http.Request, a *auditWriter) {
+	a.record.Latency = time.Since(a.record.Time)
+	if a.record.StatusCode == 0 {
+		a.record.StatusCode = http.StatusOK
+	}
+
+	s.requestLog(r).Info("Action attempt", Fields{
+		"action": a.record.Action,
+		"reportId": a.record.ReportId,
+		"user": a.record.UserHash,
+		"outcome": a.record.Outcome,
+		"status": a.record.StatusCode,
+		"latencyMs": float64(a.record.Latency) / float64(time.Millisecond),
+	})
+
+	if s.Audit == nil {
+		return
+	}
+	if err := s.Audit.Record(a.record); err != nil {
+		s.requestLog(r).Error("Cannot record audit", Fields{"error": err})
+	}
+}
@@ -0,0 +1,118 @@
+package podd_service_notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MemoryAuditSink struct {
+	Records *[]AuditRecord
+	Lock    *sync.Mutex
+}
+
+func NewMemoryAuditSink() MemoryAuditSink {
+	return MemoryAuditSink{Records: &[]AuditRecord{}, Lock: &sync.Mutex{}}
+}
+
+func (m MemoryAuditSink) Record(record AuditRecord) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	*m.Records = append(*m.Records, record)
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelInfo)
+
+	entry := logger.With(Fields{"requestId": "abc"})
+	entry.Debug("hidden")
+	entry.Warn("Cannot do it", Fields{"error": errors.New("boom"), "reportId": 1})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("debug must be filtered by level, got %d lines", len(lines))
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatalf("log line must be JSON, %v", err)
+	}
+	if line["level"] != "warn" || line["msg"] != "Cannot do it" || line["requestId"] != "abc" || line["error"] != "boom" || line["reportId"] != float64(1) {
+		t.Errorf("unexpected log line %v", line)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, line["time"].(string)); err != nil {
+		t.Errorf("log line must carry time, %v", err)
+	}
+}
+
+func TestActionHandlerAudit(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+		Logger: NewLogger(&bytes.Buffer{}, LevelInfo),
+		Audit: sink,
+	}
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if len(*sink.Records) != 0 {
+		t.Errorf("viewing the form must not be audited")
+	}
+	if rr.Header().Get(RequestIdHeader) == "" {
+		t.Errorf("response must carry request id")
+	}
+
+	for _, form := range []string{"isOutbreak=1", "isVerified=0&isOutbreak=1", "isVerified=0&isOutbreak=1"} {
+		req, _ = http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, form)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(RequestIdHeader, "req-" + form)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	records := *sink.Records
+	if len(records) != 3 {
+		t.Fatalf("every submit must be audited, got %d records", len(records))
+	}
+
+	for i, want := range []string{StatusValidationErrors, StatusOK, StatusAlreadyProcessed} {
+		if records[i].Outcome != want {
+			t.Errorf("record %d outcome: got %q want %q", i, records[i].Outcome, want)
+		}
+	}
+
+	record := records[1]
+	if record.ReportId != 1234 || record.Action != ActionVerifyReport || record.RefNo != payload.RefNo || record.StatusCode != http.StatusOK {
+		t.Errorf("record must describe the attempt, got %+v", record)
+	}
+	if record.UserHash == "" || strings.Contains(record.UserHash, "1234") {
+		t.Errorf("record must carry a hash of the user token, got %q", record.UserHash)
+	}
+	if record.Answers.Get("isVerified") != "0" || record.Answers.Get(CSRFField) != "" {
+		t.Errorf("record must carry submitted answers only, got %v", record.Answers)
+	}
+	if record.RequestId != "req-isVerified=0&isOutbreak=1" {
+		t.Errorf("record must carry request id of the proxy, got %q", record.RequestId)
+	}
+	if record.Latency <= 0 {
+		t.Errorf("record must carry latency")
+	}
+}
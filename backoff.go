@@ -0,0 +1,45 @@
+package podd_service_notify
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultBackoffMin = 500 * time.Millisecond
+	DefaultBackoffMax = 30 * time.Second
+)
+
+// Backoff doubles the wait after every failure up to Max, the wait is
+// jittered so reconnecting servers do not hit redis at once.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	failures uint
+}
+
+// Next wait after one more failure
+func (b *Backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = DefaultBackoffMin
+	}
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+
+	wait := max
+	if b.failures < 32 && min << b.failures < max {
+		wait = min << b.failures
+	}
+	b.failures++
+
+	// half of wait is fixed, the other half is random
+	return wait / 2 + time.Duration(rand.Int63n(int64(wait / 2) + 1))
+}
+
+// Reset after a success
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
@@ -0,0 +1,22 @@
+package podd_service_notify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	backoff := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if wait := backoff.Next(); wait < max / 2 || wait > max {
+			t.Errorf("wait %d must be within [%v, %v], got %v", i, max / 2, max, wait)
+		}
+	}
+
+	backoff.Reset()
+	if wait := backoff.Next(); wait > 100 * time.Millisecond {
+		t.Errorf("wait after reset must start over, got %v", wait)
+	}
+}
@@ -0,0 +1,133 @@
+package podd_service_notify
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// form field carrying the CSRF token of a rendered form
+const CSRFField = "csrf"
+
+// how long a rendered form can be submitted
+const DefaultCSRFTTL = 24 * time.Hour
+
+var ErrInvalidCSRF = errors.New("invalid csrf token")
+
+func (s Server) csrfTTL() time.Duration {
+	if s.CSRFTTL == 0 {
+		return DefaultCSRFTTL
+	}
+	return s.CSRFTTL
+}
+
+// CSRFKey, or a key derived from the active cipher when empty
+func (s Server) csrfKey() []byte {
+	if s.CSRFKey != "" {
+		return []byte(s.CSRFKey)
+	}
+
+	c, _ := s.Keyring.Active()
+	sum := sha256.Sum256([]byte("csrf:" + c.Key))
+	return sum[:]
+}
+
+func (s Server) csrfMAC(refNo string, nonce string, issued string) string {
+	mac := hmac.New(sha256.New, s.csrfKey())
+	mac.Write([]byte(refNo + "." + nonce + "." + issued))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewCSRFToken returns a fresh "nonce.issued.mac" token bound to refNo,
+// every rendered form gets its own token.
+func (s Server) NewCSRFToken(refNo string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	return nonce + "." + issued + "." + s.csrfMAC(refNo, nonce, issued), nil
+}
+
+// CheckCSRFToken returns ErrInvalidCSRF unless token is issued for refNo by
+// NewCSRFToken within CSRFTTL.
+func (s Server) CheckCSRFToken(refNo string, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidCSRF
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(s.csrfMAC(refNo, parts[0], parts[1]))) {
+		return ErrInvalidCSRF
+	}
+
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Since(time.Unix(issued, 0)) > s.csrfTTL() {
+		return ErrInvalidCSRF
+	}
+	return nil
+}
+
+// empty token when it cannot be created, the submit is then rejected
+func (s Server) csrfToken(payload Payload) string {
+	token, err := s.NewCSRFToken(payload.RefNo)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+func (s Server) allowedOrigin(origin string) bool {
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// same origin requests and requests without Origin, i.e. not from a
+// browser page, are always allowed
+func (s Server) allowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return s.allowedOrigin(origin)
+}
+
+// set CORS headers for an origin in AllowedOrigins, true when request is a
+// preflight which is fully answered
+func (s Server) setCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin != "" && s.allowedOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method != "OPTIONS" {
+		return false
+	}
+
+	if origin != "" && s.allowedOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Accept-Language")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,163 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func csrfToken(server Server, payload Payload) string {
+	token, _ := server.NewCSRFToken(payload.RefNo)
+	return token
+}
+
+// append csrf token of payload to url encoded form
+func withCSRF(server Server, payload Payload, form string) string {
+	return form + "&" + CSRFField + "=" + csrfToken(server, payload)
+}
+
+func TestCSRFToken(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+	}
+
+	token, err := server.NewCSRFToken("refno")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := server.NewCSRFToken("refno"); other == token {
+		t.Errorf("every render must get its own token")
+	}
+
+	if err := server.CheckCSRFToken("refno", token); err != nil {
+		t.Errorf("token must be accepted for its refNo, %v", err)
+	}
+	if err := server.CheckCSRFToken("other", token); err != ErrInvalidCSRF {
+		t.Errorf("token must be bound to refNo")
+	}
+	if err := server.CheckCSRFToken("refno", token + "x"); err != ErrInvalidCSRF {
+		t.Errorf("tampered token must be rejected")
+	}
+	if err := server.CheckCSRFToken("refno", ""); err != ErrInvalidCSRF {
+		t.Errorf("missing token must be rejected")
+	}
+
+	other := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "6543210987654321",
+		}),
+	}
+	if err := other.CheckCSRFToken("refno", token); err != ErrInvalidCSRF {
+		t.Errorf("token of another key must be rejected")
+	}
+
+	server.CSRFTTL = -time.Second
+	if err := server.CheckCSRFToken("refno", token); err != ErrInvalidCSRF {
+		t.Errorf("token older than CSRFTTL must be rejected")
+	}
+}
+
+func TestVerifyReportHandlerCSRF(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: cache,
+	}
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `name="csrf" value="`) {
+		t.Errorf("form must carry a csrf token")
+	}
+
+	req, _ = http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader("isVerified=1&isOutbreak=0"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden || atomic.LoadInt32(&count) != 0 {
+		t.Errorf("submit without csrf token must be rejected, got %d", rr.Code)
+	}
+	if state, _ := cache.Get(payload.RefNo); state != "" {
+		t.Errorf("refNo must stay unclaimed on forged submit, got %q", state)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, `name="csrf" value="`) || !strings.Contains(body, `value="1" required checked`) {
+		t.Errorf("form must be re-rendered with a fresh token and the submitted answers")
+	}
+}
+
+func TestActionHandlerOrigin(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+		AllowedOrigins: []string{"https://app.example.org"},
+	}
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	form := withCSRF(server, payload, "isVerified=1&isOutbreak=0")
+
+	submit := func(origin string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "http://notify.example.org/report/verify/" + payloadStr, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", origin)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := submit("https://evil.example.com")
+	if rr.Code != http.StatusForbidden || atomic.LoadInt32(&count) != 0 {
+		t.Errorf("submit from other origin must be rejected, got %d", rr.Code)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin must not be allowed by CORS")
+	}
+
+	req, _ := http.NewRequest("OPTIONS", "/report/verify/" + payloadStr, nil)
+	req.Header.Set("Origin", "https://app.example.org")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.org" || atomic.LoadInt32(&count) != 0 {
+		t.Errorf("preflight must be answered without submitting, got %d", rr.Code)
+	}
+
+	rr = submit("https://app.example.org")
+	if rr.Code != http.StatusOK || atomic.LoadInt32(&count) != 1 {
+		t.Errorf("submit from allowed origin must be accepted, got %d", rr.Code)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.org" {
+		t.Errorf("allowed origin must be echoed by CORS")
+	}
+
+	// same origin page of the server itself
+	other, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	otherStr, _ := server.Keyring.EncodePayload(other)
+	req, _ = http.NewRequest("POST", "http://notify.example.org/report/verify/" + otherStr, strings.NewReader(withCSRF(server, other, "isVerified=1&isOutbreak=0")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://notify.example.org")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("same origin submit must be accepted, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,284 @@
+package podd_service_notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// question types
+const (
+	FieldRadio    = "radio"
+	FieldCheckbox = "checkbox"
+	FieldNumber   = "number"
+	FieldText     = "text"
+)
+
+type Option struct {
+	Value  string            `json:"value"`
+	Label  string            `json:"label"`
+	// Label by locale
+	Labels map[string]string `json:"labels,omitempty"`
+	// text reported to PODD as extra info, Label when empty
+	Info   string            `json:"info"`
+}
+
+type FormField struct {
+	Name     string            `json:"id"`
+	Type     string            `json:"type"`
+	Label    string            `json:"label"`
+	// Label by locale
+	Labels   map[string]string `json:"labels,omitempty"`
+	Options  []Option          `json:"options"`
+	Required bool              `json:"required"`
+}
+
+// return label of locale, Label when not translated
+func (f FormField) LabelIn(locale string) string {
+	return labelIn(f.Labels, locale, f.Label)
+}
+
+// return label of locale, Label when not translated
+func (o Option) LabelIn(locale string) string {
+	return labelIn(o.Labels, locale, o.Label)
+}
+
+func labelIn(labels map[string]string, locale string, label string) string {
+	if l, ok := labels[locale]; ok && l != "" {
+		return l
+	}
+	return label
+}
+
+func (f FormField) option(value string) (Option, bool) {
+	for _, option := range f.Options {
+		if option.Value == value {
+			return option, true
+		}
+	}
+	return Option{}, false
+}
+
+// questions an action asks on submit, other submitted values are dropped
+type Form struct {
+	Fields []FormField `json:"questions"`
+}
+
+func (f Form) filter(values url.Values) url.Values {
+	filtered := url.Values{}
+	for _, field := range f.Fields {
+		if v, ok := values[field.Name]; ok {
+			filtered[field.Name] = v
+		}
+	}
+	return filtered
+}
+
+// Parse validates submitted values against the form, errors are message keys
+// keyed by field name.
+func (f Form) Parse(values url.Values) (Answers, map[string]string) {
+	answers := make(Answers, 0, len(f.Fields))
+	errors := make(map[string]string)
+
+	for _, field := range f.Fields {
+		submitted := make([]string, 0)
+		for _, v := range values[field.Name] {
+			if v = strings.TrimSpace(v); v != "" {
+				submitted = append(submitted, v)
+			}
+		}
+
+		if len(submitted) == 0 {
+			if field.Required {
+				errors[field.Name] = MessageRequired
+			}
+			continue
+		}
+
+		answer := Answer{Field: field, Values: submitted}
+		switch field.Type {
+		case FieldRadio, FieldCheckbox:
+			if field.Type == FieldRadio && len(submitted) > 1 {
+				errors[field.Name] = MessageInvalidOption
+				continue
+			}
+			for _, v := range submitted {
+				if _, ok := field.option(v); !ok {
+					errors[field.Name] = MessageInvalidOption
+				}
+			}
+		case FieldNumber:
+			number, err := strconv.ParseFloat(submitted[0], 64)
+			if err != nil || len(submitted) > 1 {
+				errors[field.Name] = MessageInvalidNumber
+			}
+			answer.Number = number
+		default:
+			answer.Values = submitted[:1]
+		}
+
+		if _, failed := errors[field.Name]; !failed {
+			answers = append(answers, answer)
+		}
+	}
+
+	return answers, errors
+}
+
+type Answer struct {
+	Field  FormField
+	Values []string
+	// parsed value of number field
+	Number float64
+}
+
+// first value, radio, number and text have exactly one
+func (a Answer) Value() string {
+	if len(a.Values) == 0 {
+		return ""
+	}
+	return a.Values[0]
+}
+
+// human readable answer, option info or label for choices
+func (a Answer) Info() string {
+	switch a.Field.Type {
+	case FieldRadio, FieldCheckbox:
+		infos := make([]string, 0, len(a.Values))
+		for _, v := range a.Values {
+			option, _ := a.Field.option(v)
+			if option.Info != "" {
+				infos = append(infos, option.Info)
+			} else {
+				infos = append(infos, option.Label)
+			}
+		}
+		return strings.Join(infos, ", ")
+	}
+	return a.Field.Label + " " + a.Value()
+}
+
+// answers in form order
+type Answers []Answer
+
+func (a Answers) Get(name string) (Answer, bool) {
+	for _, answer := range a {
+		if answer.Field.Name == name {
+			return answer, true
+		}
+	}
+	return Answer{}, false
+}
+
+// return empty string when not answered
+func (a Answers) Value(name string) string {
+	answer, _ := a.Get(name)
+	return answer.Value()
+}
+
+// questionnaires keyed by report type id, "default" is used for other types
+type Questionnaires map[string]Form
+
+const DefaultQuestionnaire = "default"
+
+// RequiredQuestion is a question a callback cannot do without.
+type RequiredQuestion struct {
+	Name string
+	// option values the callback understands, any value when empty
+	Values []string
+}
+
+// LoadQuestionnaires reads questionnaires of path, every form must ask the
+// required questions its callback cannot do without.
+func LoadQuestionnaires(path string, required ...RequiredQuestion) (Questionnaires, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var q Questionnaires
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, err
+	}
+	for key, form := range q {
+		if err := form.Validate(required...); err != nil {
+			return nil, fmt.Errorf("questionnaire %s: %v", key, err)
+		}
+	}
+	return q, nil
+}
+
+// Validate returns an error of the first malformed question, or of a
+// required question missing from the form, not marked as required or with
+// options other than the values of its callback.
+func (f Form) Validate(required ...RequiredQuestion) error {
+	names := make(map[string]FormField, len(f.Fields))
+	for _, field := range f.Fields {
+		if field.Name == "" {
+			return fmt.Errorf("question %q has no id", field.Label)
+		}
+		if _, ok := names[field.Name]; ok {
+			return fmt.Errorf("question %s is asked twice", field.Name)
+		}
+		names[field.Name] = field
+
+		switch field.Type {
+		case FieldRadio, FieldCheckbox:
+			if len(field.Options) == 0 {
+				return fmt.Errorf("question %s has no options", field.Name)
+			}
+		case FieldNumber, FieldText:
+		default:
+			return fmt.Errorf("question %s has unknown type %q", field.Name, field.Type)
+		}
+	}
+
+	for _, question := range required {
+		field, ok := names[question.Name]
+		if !ok {
+			return fmt.Errorf("question %s is missing", question.Name)
+		}
+		if !field.Required {
+			return fmt.Errorf("question %s must be required", question.Name)
+		}
+		if len(question.Values) == 0 {
+			continue
+		}
+
+		// the callback rejects an answer it does not know for good
+		if field.Type != FieldRadio {
+			return fmt.Errorf("question %s must be a radio", question.Name)
+		}
+		for _, option := range field.Options {
+			if !containsString(question.Values, option.Value) {
+				return fmt.Errorf("question %s has option %q, only %s are understood", question.Name, option.Value, strings.Join(question.Values, ", "))
+			}
+		}
+		for _, value := range question.Values {
+			if _, ok := field.option(value); !ok {
+				return fmt.Errorf("question %s has no option %q", question.Name, value)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (q Questionnaires) For(reportTypeId string) (Form, bool) {
+	if form, ok := q[reportTypeId]; ok {
+		return form, true
+	}
+	form, ok := q[DefaultQuestionnaire]
+	return form, ok
+}
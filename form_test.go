@@ -0,0 +1,109 @@
+package podd_service_notify
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestFormParse(t *testing.T) {
+	form := Form{
+		Fields: []FormField{
+			{Name: "isVerified", Type: FieldRadio, Required: true, Options: []Option{{Value: "1"}, {Value: "0"}}},
+			{Name: "sickAnimals", Type: FieldNumber, Required: true},
+			{Name: "symptoms", Type: FieldCheckbox, Options: []Option{{Value: "fever", Label: "มีไข้"}, {Value: "death", Label: "ตาย"}}},
+			{Name: "note", Type: FieldText, Label: "หมายเหตุ"},
+		},
+	}
+
+	answers, errors := form.Parse(url.Values{
+		"isVerified": {"1"},
+		"sickAnimals": {"4"},
+		"symptoms": {"fever", "death"},
+	})
+	if len(errors) != 0 {
+		t.Fatalf("valid submit must not have errors, got %v", errors)
+	}
+
+	if answers.Value("isVerified") != "1" {
+		t.Errorf("radio answer is not correct")
+	}
+	if answer, _ := answers.Get("sickAnimals"); answer.Number != 4 {
+		t.Errorf("number answer is not correct, got %v", answer.Number)
+	}
+	if answer, _ := answers.Get("symptoms"); answer.Info() != "มีไข้, ตาย" {
+		t.Errorf("checkbox info is not correct, got %q", answer.Info())
+	}
+	if _, ok := answers.Get("note"); ok {
+		t.Errorf("optional unanswered question must not be in answers")
+	}
+
+	_, errors = form.Parse(url.Values{
+		"isVerified": {"2"},
+		"sickAnimals": {"many"},
+		"symptoms": {"fever", "cough"},
+	})
+	for name, reason := range map[string]string{"isVerified": "invalid_option", "sickAnimals": "invalid_number", "symptoms": "invalid_option"} {
+		if errors[name] != reason {
+			t.Errorf("error of %s is %q, want %q", name, errors[name], reason)
+		}
+	}
+
+	_, errors = form.Parse(url.Values{})
+	if errors["isVerified"] != "required" || errors["sickAnimals"] != "required" || len(errors) != 2 {
+		t.Errorf("required questions must be reported, got %v", errors)
+	}
+}
+
+func TestQuestionnairesFor(t *testing.T) {
+	q := Questionnaires{
+		DefaultQuestionnaire: Form{Fields: []FormField{{Name: "a"}}},
+		"12": Form{Fields: []FormField{{Name: "b"}}},
+	}
+
+	if form, _ := q.For("12"); form.Fields[0].Name != "b" {
+		t.Errorf("questionnaire of report type must be used")
+	}
+	if form, _ := q.For("3"); form.Fields[0].Name != "a" {
+		t.Errorf("default questionnaire must be used for other report types")
+	}
+	if _, ok := Questionnaires(nil).For("3"); ok {
+		t.Errorf("no questionnaire must be found in empty questionnaires")
+	}
+}
+
+func TestLoadSampleQuestionnaires(t *testing.T) {
+	q, err := LoadQuestionnaires("program/server/sample-questionnaires.json", isVerified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form, _ := q.For("12")
+	if len(form.Fields) != 4 || form.Fields[1].Type != FieldNumber {
+		t.Errorf("sample questionnaire is not loaded correctly, got %v", form)
+	}
+}
+
+var isVerified = RequiredQuestion{Name: "isVerified", Values: []string{"1", "0"}}
+
+func TestFormValidate(t *testing.T) {
+	if err := DefaultVerifyForm.Validate(isVerified); err != nil {
+		t.Errorf("default verify form must be valid, got %v", err)
+	}
+
+	invalid := map[string]Form{
+		"missing required question": {Fields: []FormField{{Name: "isOutbreak", Type: FieldRadio, Options: []Option{{Value: "1"}}}}},
+		"optional required question": {Fields: []FormField{{Name: "isVerified", Type: FieldRadio, Options: []Option{{Value: "1"}}}}},
+		"question without id": {Fields: []FormField{{Type: FieldText, Label: "note"}}},
+		"question asked twice": {Fields: []FormField{{Name: "note", Type: FieldText}, {Name: "note", Type: FieldText}}},
+		"choice without options": {Fields: []FormField{{Name: "isVerified", Type: FieldRadio, Required: true}}},
+		"unknown type": {Fields: []FormField{{Name: "isVerified", Type: "select", Required: true}}},
+		"unknown option": {Fields: []FormField{{Name: "isVerified", Type: FieldRadio, Required: true, Options: []Option{{Value: "yes"}, {Value: "no"}}}}},
+		"missing option": {Fields: []FormField{{Name: "isVerified", Type: FieldRadio, Required: true, Options: []Option{{Value: "1"}}}}},
+		"not a radio": {Fields: []FormField{{Name: "isVerified", Type: FieldText, Required: true}}},
+	}
+	for name, form := range invalid {
+		if err := form.Validate(isVerified); err == nil {
+			t.Errorf("form with %s must be invalid", name)
+		}
+	}
+}
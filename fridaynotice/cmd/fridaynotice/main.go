@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"github.com/openpodd/podd-service-notify"
 	"github.com/openpodd/podd-service-notify/fridaynotice"
 	"github.com/vharitonsky/iniflags"
 	"log"
@@ -16,22 +17,35 @@ const defaultGCMAPIKey = "YOUR_GCM_API_KEY"
 var (
 	dsn             = flag.String("dsn", defaultDSN, "DSN string, or use environment variable FRIDAYNOTICE_DSN")
 	gcmApiKey       = flag.String("gcmApiKey", defaultGCMAPIKey, "GCM API key, or use environment variable FRIDAYNOTICE_GCM_API_KEY")
-	nonce           = flag.String("nonce", "", "Nonce")
+	nonce           = flag.String("nonce", "", "Nonce of legacy fixed-nonce tokens, unused for new tokens")
 	sharedKey       = flag.String("sharedKey", "SHARED_KEY", "Shared key")
+	tokenEncoding   = flag.String("tokenEncoding", "hex", "Encoding of report button tokens, hex or base64url")
+	sharedKeyId     = flag.String("sharedKeyId", "1", "Id of the shared key, must match key.id of the server")
 	returnServerUrl = flag.String("returnServerUrl", "http://localhost:9110/report/zero/", "Return server url")
 	messagesFlag    = flag.String("messages", "อาสาผ่อดีดีตรวจสอบเหตุการณ์ในพื้นที่ของตนเอง ถ้าไม่มีสิ่งใดผิดปกติ กรุณาส่งรายงานไม่พบเหตุการณ์ผิดปกติมายังโครงการผ่อดีดีด้วย ขอบคุณค่ะ", "Set of messages to send separated by ### (triple sharp)")
+	messagesEnFlag  = flag.String("messages.en", "", "English messages separated by ###, messages is used when empty")
+	messagesLoFlag  = flag.String("messages.lo", "", "Lao messages separated by ###, messages is used when empty")
+	localeColumn    = flag.String("localeColumn", "", "Column of accounts_user holding the user's locale (th, en, lo)")
 	debugFlag       = flag.Bool("debug", false, "Debug flag")
 	testUsername    = flag.String("testUsername", "podd.demo", "Test username")
 	reportButton    = flag.Bool("reportButton", false, "Enable report button")
+	metricsFile     = flag.String("metricsFile", "", "Write prometheus metrics of the run to this file for the node_exporter textfile collector")
 )
 
 var messages []string
+var localizedMessages = map[string][]string{}
 
 func init() {
 	iniflags.Parse()
 	log.Println("dsn: ", *dsn)
 
 	messages = strings.Split(*messagesFlag, "###")
+	if *messagesEnFlag != "" {
+		localizedMessages["en"] = strings.Split(*messagesEnFlag, "###")
+	}
+	if *messagesLoFlag != "" {
+		localizedMessages["lo"] = strings.Split(*messagesLoFlag, "###")
+	}
 
 	if *dsn == defaultDSN && os.Getenv("FRIDAYNOTICE_DSN") != "" {
 		*dsn = os.Getenv("FRIDAYNOTICE_DSN")
@@ -43,10 +57,19 @@ func init() {
 }
 
 func main() {
+	encoding, err := podd_service_notify.ParseTokenEncoding(*tokenEncoding)
+	if err != nil {
+		panic(err)
+	}
+
 	msgr, err := fridaynotice.NewRandomMessenger(fridaynotice.RandomMessengerConfig{
 		DSN:                 *dsn,
 		Messages:            messages,
+		LocalizedMessages:   localizedMessages,
+		LocaleColumn:        *localeColumn,
 		SharedKey:           *sharedKey,
+		SharedKeyId:         *sharedKeyId,
+		TokenEncoding:       encoding,
 		Nonce:               *nonce,
 		ReturnUrl:           *returnServerUrl,
 		ReportButtonEnabled: *reportButton,
@@ -70,4 +93,10 @@ func main() {
 	for _, user := range users {
 		msgr.SendNotificationToUser(sender, user)
 	}
+
+	if *metricsFile != "" {
+		if err := podd_service_notify.DefaultMetrics.WriteFile(*metricsFile); err != nil {
+			log.Println("Cannot write metrics", err)
+		}
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/openpodd/podd-service-notify"
 	"log"
 	"math/rand"
+	"regexp"
 	"strconv"
 	"time"
 )
@@ -28,12 +29,15 @@ type User struct {
 	Username string
 	Token    string
 	Device   Device
+	// empty means podd_service_notify.DefaultLocale
+	Locale string
 }
 
 type GCMMessage map[string]interface{}
 
+// prompt, button label, report url and thank-you text of the user's locale
 const buttonTemplates = `
-กดลิ้งค์เพื่อรายงาน <p><button id="submit-link" onclick="submit(); return false;" style="border:none;padding: 10px;color: #fff;margin: 15px 0 0;font-size: 18px;background-color: #1C95EF;"style="border:none;padding: 10px;color: #fff;margin: 15px 0 0;font-size: 18px;background-color: #1C95EF;">ไม่พบเหตุผิดปกติ</button></p>
+%[1]s <p><button id="submit-link" onclick="submit(); return false;" style="border:none;padding: 10px;color: #fff;margin: 15px 0 0;font-size: 18px;background-color: #1C95EF;"style="border:none;padding: 10px;color: #fff;margin: 15px 0 0;font-size: 18px;background-color: #1C95EF;">%[2]s</button></p>
 <script>
 var submitLink = document.getElementById('submit-link');
 
@@ -43,11 +47,11 @@ function submit() {
 	oReq.onreadystatechange = function () {
 		if (oReq.readyState === 4 && oReq.status === 200) {
 			var wrapper = document.getElementsByClassName("wrapper");
-			wrapper[0].innerText = "ขอบคุณสำหรับการรายงานค่ะ";
+			wrapper[0].innerText = "%[4]s";
 		}
 	};
 
-	oReq.open("GET", "%s");
+	oReq.open("GET", "%[3]s");
 	oReq.send();
 }
 </script>
@@ -56,25 +60,36 @@ function submit() {
 type RandomMessengerConfig struct {
 	DSN      string
 	Messages []string
+	// Messages by locale, Messages is used for a locale not listed here
+	LocalizedMessages map[string][]string
+	// column of accounts_user holding the user's locale, empty means default locale
+	LocaleColumn string
 
-	SharedKey string
-	Nonce     string
-	ReturnUrl string
+	SharedKey     string
+	SharedKeyId   string
+	Nonce         string
+	TokenEncoding podd_service_notify.TokenEncoding
+	ReturnUrl     string
 
 	ReportButtonEnabled bool
 }
 
 type RandomMessenger struct {
-	DB     *sql.DB
-	Config RandomMessengerConfig
-	Cipher podd_service_notify.Cipher
+	DB      *sql.DB
+	Config  RandomMessengerConfig
+	Keyring podd_service_notify.Keyring
 }
 
 func (m *RandomMessenger) GetVolunteers(username string) []*User {
 	users := make([]*User, 0)
 
+	localeSelect := "''"
+	if m.Config.LocaleColumn != "" {
+		localeSelect = "COALESCE(u." + m.Config.LocaleColumn + ", '')"
+	}
+
 	queryString := `
-		SELECT username, gcm_reg_id, t.key
+		SELECT username, gcm_reg_id, t.key, ` + localeSelect + `
 		FROM accounts_user u
 	    	join accounts_userdevice d on u.id = d.user_id
 	    	join authtoken_token t on u.id = t.user_id
@@ -97,7 +112,8 @@ func (m *RandomMessenger) GetVolunteers(username string) []*User {
 		var username string
 		var gcmRegId string
 		var token string
-		err = rows.Scan(&username, &gcmRegId, &token)
+		var locale string
+		err = rows.Scan(&username, &gcmRegId, &token, &locale)
 		if err != nil {
 			panic(err)
 		}
@@ -105,6 +121,7 @@ func (m *RandomMessenger) GetVolunteers(username string) []*User {
 		users = append(users, &User{
 			Username: username,
 			Token:    token,
+			Locale:   locale,
 			Device: Device{
 				Type:  DEVICE_TYPE_ANDROID,
 				RegId: gcmRegId,
@@ -120,6 +137,17 @@ func (m *RandomMessenger) GetMessage() string {
 	return m.Config.Messages[rand.Intn(len(m.Config.Messages))]
 }
 
+// random message of locale, GetMessage when locale has no messages
+func (m *RandomMessenger) GetMessageIn(locale string) string {
+	messages := m.Config.LocalizedMessages[locale]
+	if len(messages) == 0 {
+		return m.GetMessage()
+	}
+
+	rand.Seed(time.Now().Unix())
+	return messages[rand.Intn(len(messages))]
+}
+
 func (m *RandomMessenger) MakeRegIdsChunks(users []*User, chunkSize int) [][]string {
 	var chunks [][]string
 	chunks = make([][]string, 0)
@@ -162,6 +190,7 @@ func (m *RandomMessenger) SendNotification(sender Sender, regIdsChunks [][]strin
 		message.TimeToLive = 604800 // 60 * 60 * 24 * 7
 
 		response, err := sender.Send(message, 3)
+		podd_service_notify.DefaultMetrics.ObserveSend(response, err, len(regIds))
 		if err != nil {
 			log.Print("Fail with error ", err, response)
 
@@ -179,18 +208,28 @@ func (m *RandomMessenger) SendNotification(sender Sender, regIdsChunks [][]strin
 }
 
 func (m *RandomMessenger) CreateGCMMessageTextForUser(user *User) string {
-	cipher := m.Cipher
-
-	messageText := m.GetMessage()
+	locale := podd_service_notify.SupportedLocale(user.Locale)
+	messageText := m.GetMessageIn(locale)
+	if locale == "" {
+		locale = podd_service_notify.DefaultLocale
+	}
 
-	payload, err := podd_service_notify.CreatePayload(user.Token, 0, time.Hour*24*7)
+	payload, err := podd_service_notify.CreatePayload(podd_service_notify.ActionZeroReport, user.Token, 0, time.Hour*24*7)
 	if err == nil {
-		payloadStr, err := cipher.EncodePayload(payload)
+		if user.Locale != "" {
+			payload.SetClaim(podd_service_notify.ClaimLocale, locale)
+		}
+		payloadStr, err := m.Keyring.EncodePayload(payload)
 		if err != nil {
 			log.Printf("Error coding payload for user %s", user.Username)
 			log.Println(err)
 		} else if m.Config.ReportButtonEnabled {
-			messageText += fmt.Sprintf(buttonTemplates, m.Config.ReturnUrl+"/"+payloadStr)
+			podd_service_notify.DefaultMetrics.LinksIssued.WithLabelValues(podd_service_notify.ActionZeroReport).Inc()
+			messageText += fmt.Sprintf(buttonTemplates,
+				podd_service_notify.MessageIn(locale, podd_service_notify.MessageZeroReportPrompt),
+				podd_service_notify.MessageIn(locale, podd_service_notify.MessageZeroReportButton),
+				m.Config.ReturnUrl+"/"+payloadStr,
+				podd_service_notify.MessageIn(locale, podd_service_notify.MessageZeroReportThankyou))
 		}
 	}
 
@@ -211,6 +250,7 @@ func (m *RandomMessenger) SendNotificationToUser(sender Sender, user *User) {
 	message.TimeToLive = 604800 // 60 * 60 * 24 * 7
 
 	response, err := sender.Send(message, 3)
+	podd_service_notify.DefaultMetrics.ObserveSend(response, err, len(regIds))
 	if err != nil {
 		log.Print("Fail with error", err, response)
 	} else {
@@ -218,7 +258,14 @@ func (m *RandomMessenger) SendNotificationToUser(sender Sender, user *User) {
 	}
 }
 
+var columnPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
 func NewRandomMessenger(config RandomMessengerConfig) (*RandomMessenger, error) {
+	// the column goes into the volunteers query as is
+	if config.LocaleColumn != "" && !columnPattern.MatchString(config.LocaleColumn) {
+		return nil, fmt.Errorf("invalid locale column %q", config.LocaleColumn)
+	}
+
 	db, err := sql.Open("postgres", config.DSN)
 	if err != nil {
 		return nil, err
@@ -226,10 +273,11 @@ func NewRandomMessenger(config RandomMessengerConfig) (*RandomMessenger, error)
 	m := RandomMessenger{
 		DB:     db,
 		Config: config,
-		Cipher: podd_service_notify.Cipher{
-			Key:   config.SharedKey,
-			Nonce: config.Nonce,
-		},
+		Keyring: podd_service_notify.NewKeyring(config.SharedKeyId, podd_service_notify.Cipher{
+			Key:      config.SharedKey,
+			Nonce:    config.Nonce,
+			Encoding: config.TokenEncoding,
+		}),
 	}
 
 	return &m, nil
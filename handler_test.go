@@ -6,64 +6,127 @@ import (
 	"net/http/httptest"
 	"time"
 	"fmt"
+	"sync"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"errors"
 )
 
 type MemoryCache struct {
-	Map map[string]string
+	Map     map[string]string
+	Expires map[string]time.Time
+	Lock    *sync.Mutex
 }
 
-func (m MemoryCache) Exists(refNo string) bool {
-	if _, ok := m.Map[refNo]; ok {
-		return true
-	} else {
-		return false
+func NewMemoryCache() MemoryCache {
+	return MemoryCache{
+		Map: make(map[string]string),
+		Expires: make(map[string]time.Time),
+		Lock: &sync.Mutex{},
+	}
+}
+
+func (m MemoryCache) expire(key string) {
+	if expire, ok := m.Expires[key]; ok && time.Now().After(expire) {
+		delete(m.Map, key)
+		delete(m.Expires, key)
 	}
 }
 
-func (m MemoryCache) Set(key string, value string) error {
+func (m MemoryCache) Get(key string) (string, error) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.expire(key)
+	return m.Map[key], nil
+}
+
+func (m MemoryCache) set(key string, value string, ttl time.Duration) {
 	m.Map[key] = value
+	if ttl > 0 {
+		m.Expires[key] = time.Now().Add(ttl)
+	} else {
+		delete(m.Expires, key)
+	}
+}
+
+func (m MemoryCache) Set(key string, value string, ttl time.Duration) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.set(key, value, ttl)
 	return nil
 }
 
-func TestZeroReportHandlerExpired(t *testing.T) {
-	req, err := http.NewRequest("GET", "/report/zero/f8b0c1afb84f65264835f26738e76b8abfb6b32bbb17bebb6996c999204ba8f469321c39ae9e772d98c29a8cf43762374c177704bf0f04932925f3b473be3cc8d22a395a3f024b4eafcedf0643ef3f9d2cf7c4c3021cdec76eff303683ff79e07b5ec04c898818bcdeff0fda5d0256805613126d1433076f885770", nil)
-	if err != nil {
-		t.Fatal(err)
+func (m MemoryCache) Claim(key string, value string, ttl time.Duration) (bool, error) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.expire(key)
+	if _, ok := m.Map[key]; ok {
+		return false, nil
+	}
+
+	m.set(key, value, ttl)
+	return true, nil
+}
+
+func (m MemoryCache) Swap(key string, old string, value string, ttl time.Duration) (bool, error) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.expire(key)
+	if current, ok := m.Map[key]; !ok || current != old {
+		return false, nil
 	}
 
+	m.set(key, value, ttl)
+	return true, nil
+}
+
+func (m MemoryCache) Delete(key string) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	delete(m.Map, key)
+	delete(m.Expires, key)
+	return nil
+}
+
+func TestZeroReportHandlerExpired(t *testing.T) {
 	server := Server{
-		Cipher: Cipher{
+		Keyring: NewKeyring("1", Cipher{
 			Key: "1234567890123456",
-			Nonce: "3a0117f29cd4261bab54b0f1",
-		},
-		Cache: MemoryCache{
-			Map: make(map[string]string),
-		},
+		}),
+		Cache: NewMemoryCache(),
 	}
 
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(server.ZeroReportHandler(nil))
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 0, -time.Second)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
 
-	handler.ServeHTTP(rr, req)
+	handler := http.HandlerFunc(server.ZeroReportHandler(nil))
+	status, response := serveJSON(handler, "GET", "/report/zero/" + payloadStr, "")
 
-	if status := rr.Code; status != http.StatusBadRequest {
+	if status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
+	if response.Status != StatusExpired {
+		t.Errorf("handler returned wrong status: got %q want %q", response.Status, StatusExpired)
+	}
 }
 
 func TestZeroReportHandler(t *testing.T) {
 	server := Server{
-		Cipher: Cipher{
+		Keyring: NewKeyring("1", Cipher{
 			Key: "1234567890123456",
 			Nonce: "3a0117f29cd4261bab54b0f1",
-		},
-		Cache: MemoryCache{
-			Map: make(map[string]string),
-		},
+		}),
+		Cache: NewMemoryCache(),
 	}
 
-	payload, _ := CreatePayload("1234", 1234, time.Second * 1000)
-	payloadStr, _ := server.Cipher.EncodePayload(payload)
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
 	fmt.Println(payloadStr)
 
 	req, err := http.NewRequest("GET", "/report/zero/" + payloadStr, nil)
@@ -88,17 +151,15 @@ func TestZeroReportHandler(t *testing.T) {
 
 func TestServer_VerifyReportHandler(t *testing.T) {
 	server := Server{
-		Cipher: Cipher{
+		Keyring: NewKeyring("1", Cipher{
 			Key: "1234567890123456",
 			Nonce: "3a0117f29cd4261bab54b0f1",
-		},
-		Cache: MemoryCache{
-			Map: make(map[string]string),
-		},
+		}),
+		Cache: NewMemoryCache(),
 	}
 
-	payload, _ := CreatePayload("", 160831, time.Second * 1000)
-	payloadStr, _ := server.Cipher.EncodePayload(payload)
+	payload, _ := CreatePayload(ActionVerifyReport, "", 160831, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
 	fmt.Println(payloadStr)
 
 	req, err := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
@@ -121,3 +182,310 @@ func TestServer_VerifyReportHandler(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 }
+
+func TestHandlersRejectOtherAction(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+	}
+
+	zeroPayload, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+	zeroPayloadStr, _ := server.Keyring.EncodePayload(zeroPayload)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + zeroPayloadStr, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.VerifyReportHandler(nil)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	verifyPayload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	verifyPayloadStr, _ := server.Keyring.EncodePayload(verifyPayload)
+
+	req, _ = http.NewRequest("GET", "/report/zero/" + verifyPayloadStr, nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.ZeroReportHandler(nil)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	if state, _ := server.Cache.Get(verifyPayload.RefNo); state != "" {
+		t.Errorf("rejected payload must not be marked as processed")
+	}
+}
+
+type CountingCallback struct {
+	Count *int32
+}
+
+func (c CountingCallback) Execute(payload Payload) Result {
+	atomic.AddInt32(c.Count, 1)
+	return Result{}
+}
+
+func TestVerifyReportHandlerConcurrentSubmit(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+	form := url.Values{"isVerified": {"1"}, "isOutbreak": {"0"}, CSRFField: {csrfToken(server, payload)}}.Encode()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	if count != 1 {
+		t.Errorf("callback executed %d times, want 1", count)
+	}
+}
+
+func TestZeroReportHandlerRefNoTTL(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: cache,
+		RefNoGrace: time.Hour,
+	}
+
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	req, _ := http.NewRequest("GET", "/report/zero/" + payloadStr, nil)
+	http.HandlerFunc(server.ZeroReportHandler(nil)).ServeHTTP(httptest.NewRecorder(), req)
+
+	expire, ok := cache.Expires[payload.RefNo]
+	if !ok {
+		t.Fatalf("refNo must be stored with ttl")
+	}
+
+	want := payload.Expire.Add(time.Hour)
+	if expire.Before(want.Add(-time.Minute)) || expire.After(want.Add(time.Minute)) {
+		t.Errorf("refNo expires at %v, want about %v", expire, want)
+	}
+}
+
+type FailingCallback struct {
+	Fail *bool
+}
+
+func (c FailingCallback) Execute(payload Payload) Result {
+	if *c.Fail {
+		return Retry(errors.New("api is down"))
+	}
+	return Result{}
+}
+
+func TestZeroReportHandlerRetryFailedCallback(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: cache,
+	}
+
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	fail := true
+	handler := http.HandlerFunc(server.ZeroReportHandler(FailingCallback{Fail: &fail}))
+	req, _ := http.NewRequest("GET", "/report/zero/" + payloadStr, nil)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadGateway {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadGateway)
+	}
+	if state, _ := cache.Get(payload.RefNo); state != RefNoFailed {
+		t.Errorf("refNo state is %q, want %q", state, RefNoFailed)
+	}
+
+	fail = false
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if state, _ := cache.Get(payload.RefNo); state != RefNoCommitted {
+		t.Errorf("refNo state is %q, want %q", state, RefNoCommitted)
+	}
+}
+
+func TestClaimRefNoPendingTimeout(t *testing.T) {
+	cache := NewMemoryCache()
+
+	if state, _ := ClaimRefNo(cache, "abcd", time.Millisecond * 10); state != "" {
+		t.Fatalf("new refNo must be claimed, got state %q", state)
+	}
+
+	if state, _ := ClaimRefNo(cache, "abcd", time.Millisecond * 10); state != RefNoPending {
+		t.Fatalf("pending refNo must not be claimed again, got state %q", state)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	if state, _ := ClaimRefNo(cache, "abcd", time.Millisecond * 10); state != "" {
+		t.Fatalf("stuck pending refNo must be released after timeout, got state %q", state)
+	}
+
+	cache.Set("abcd", RefNoCommitted, 0)
+	if state, _ := ClaimRefNo(cache, "abcd", time.Millisecond * 10); state != RefNoCommitted {
+		t.Fatalf("committed refNo must not be claimed, got state %q", state)
+	}
+}
+
+type RejectingCallback struct{}
+
+func (c RejectingCallback) Execute(payload Payload) Result {
+	return Reject(http.StatusBadRequest, errors.New("report not found"))
+}
+
+func TestVerifyReportHandlerRejectedCallback(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	handler := http.HandlerFunc(server.VerifyReportHandler(RejectingCallback{}))
+
+	for _, want := range []int{http.StatusBadRequest, http.StatusGone} {
+		req, _ := http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "isVerified=1&isOutbreak=0")))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != want {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, want)
+		}
+		if rr.Body.String() != Message(MessageRejected) {
+			t.Errorf("handler returned wrong body: got %q", rr.Body.String())
+		}
+	}
+}
+
+func TestVerifyReportHandlerInvalidSubmit(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: cache,
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+
+	// accidental empty submit must not mark report as a test
+	req, _ := http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "isOutbreak=1")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if count != 0 {
+		t.Errorf("callback must not be executed on invalid submit")
+	}
+	if state, _ := cache.Get(payload.RefNo); state != "" {
+		t.Errorf("refNo must stay unclaimed on invalid submit, got %q", state)
+	}
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `id="error-isVerified"`) || strings.Contains(body, `id="error-isOutbreak"`) {
+		t.Errorf("form must be re-rendered with error of missing question only")
+	}
+	if !strings.Contains(body, `value="1" required checked`) {
+		t.Errorf("form must be re-rendered with submitted answers")
+	}
+
+	req, _ = http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "isVerified=1&isOutbreak=1")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK || count != 1 {
+		t.Errorf("valid submit after invalid one must be processed, got %v", status)
+	}
+}
+
+func TestCommitRefNo(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{Cache: cache}
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+
+	for _, c := range []struct {
+		state string
+		want  string
+	}{
+		{RefNoPending, RefNoCommitted},
+		// pending timed out while the callback ran
+		{"", RefNoCommitted},
+		// claimed by another request meanwhile
+		{RefNoRejected, RefNoRejected},
+	} {
+		delete(cache.Map, payload.RefNo)
+		if c.state != "" {
+			cache.Set(payload.RefNo, c.state, 0)
+		}
+
+		server.commitRefNo(payload)
+		if state, _ := cache.Get(payload.RefNo); state != c.want {
+			t.Errorf("committing %q refNo left %q, want %q", c.state, state, c.want)
+		}
+	}
+}
+
+func TestZeroReportHandlerUnknownRefNoState(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: cache,
+	}
+
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	cache.Set(payload.RefNo, "done", 0)
+
+	var count int32
+	req, _ := http.NewRequest("GET", "/report/zero/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.ZeroReportHandler(CountingCallback{Count: &count})).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+	if count != 0 {
+		t.Errorf("callback must not run for unknown refNo state, ran %d times", count)
+	}
+}
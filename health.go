@@ -0,0 +1,274 @@
+package podd_service_notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HealthOK          = "ok"
+	HealthFail        = "fail"
+	HealthUnavailable = "unavailable"
+)
+
+const DefaultHealthTimeout = 2 * time.Second
+
+// Checker reports whether a dependency works, nil means healthy.
+type Checker interface {
+	Check() error
+}
+
+// CheckFunc adapts a function like (*sql.DB).Ping to a Checker.
+type CheckFunc func() error
+
+func (f CheckFunc) Check() error {
+	return f()
+}
+
+// Checker that also reports details, e.g. time of the last message.
+type detailedChecker interface {
+	HealthDetails() map[string]interface{}
+}
+
+// Pinger is a RefNoCache backend that can be checked without touching keys.
+type Pinger interface {
+	Ping() error
+}
+
+// CacheCheck checks the RefNoCache backend, by Ping when it has one.
+func (s Server) CacheCheck() Checker {
+	return CheckFunc(func() error {
+		if pinger, ok := s.Cache.(Pinger); ok {
+			return pinger.Ping()
+		}
+		_, err := s.Cache.Get("healthz")
+		return err
+	})
+}
+
+// HTTPCheck is healthy when URL answers without a 5xx.
+type HTTPCheck struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c HTTPCheck) Check() error {
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultHealthTimeout}
+	}
+
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("responded %s", resp.Status)
+	}
+	return nil
+}
+
+// SubscriberHealth follows a pub/sub subscriber goroutine.
+type SubscriberHealth struct {
+	// unhealthy when no message came for this long, 0 means messages may
+	// stop for any time
+	MaxSilence time.Duration
+	// Live fails when the subscriber cannot reconnect for this long,
+	// 0 means it never fails
+	MaxDown time.Duration
+
+	lock        sync.Mutex
+	subscribed  bool
+	// of the last subscribe, or of the first failure since
+	since       time.Time
+	lastMessage time.Time
+	err         error
+	failures    int
+}
+
+// Subscribed is called once the subscription is confirmed.
+func (h *SubscriberHealth) Subscribed() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subscribed = true
+	h.since = time.Now()
+	h.err = nil
+}
+
+func (h *SubscriberHealth) Received() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastMessage = time.Now()
+}
+
+// Failed is called when the subscriber stops receiving.
+func (h *SubscriberHealth) Failed(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.subscribed || h.since.IsZero() {
+		h.since = time.Now()
+	}
+	h.subscribed = false
+	h.err = err
+	h.failures++
+}
+
+func (h *SubscriberHealth) LastMessage() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.lastMessage
+}
+
+func (h *SubscriberHealth) Check() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.subscribed {
+		if h.err != nil {
+			return fmt.Errorf("subscriber stopped: %v", h.err)
+		}
+		return errors.New("subscriber is not subscribed yet")
+	}
+
+	if h.MaxSilence > 0 {
+		last := h.lastMessage
+		if last.Before(h.since) {
+			last = h.since
+		}
+		if silence := time.Since(last); silence > h.MaxSilence {
+			return fmt.Errorf("no message for %s", silence.Truncate(time.Second))
+		}
+	}
+	return nil
+}
+
+// Live is the liveness check, a subscriber that reconnects is still live
+// until it is down for MaxDown.
+func (h *SubscriberHealth) Live() Checker {
+	return CheckFunc(func() error {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		if h.subscribed || h.MaxDown == 0 || h.since.IsZero() {
+			return nil
+		}
+		if down := time.Since(h.since); down > h.MaxDown {
+			return fmt.Errorf("subscriber down for %s: %v", down.Truncate(time.Second), h.err)
+		}
+		return nil
+	})
+}
+
+func (h *SubscriberHealth) HealthDetails() map[string]interface{} {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	details := map[string]interface{}{"failures": h.failures}
+	if !h.since.IsZero() {
+		details["since"] = h.since.UTC()
+	}
+	if !h.lastMessage.IsZero() {
+		details["lastMessage"] = h.lastMessage.UTC()
+	}
+	return details
+}
+
+// HealthStatus is the body of health endpoints.
+type HealthStatus struct {
+	Status string                            `json:"status"`
+	Checks map[string]map[string]interface{} `json:"checks"`
+}
+
+// Health serves kubernetes probes, every check of a probe must pass.
+type Health struct {
+	// checks of /healthz, failing them means the process must restart
+	Live map[string]Checker
+	// checks of /readyz, failing them means no traffic for now
+	Ready map[string]Checker
+	// of every check, DefaultHealthTimeout when 0
+	Timeout time.Duration
+}
+
+func (h Health) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return DefaultHealthTimeout
+	}
+	return h.Timeout
+}
+
+// run checks at once, a check taking longer than timeout fails
+func (h Health) run(checks map[string]Checker) HealthStatus {
+	type result struct {
+		name string
+		err  error
+	}
+
+	results := make(chan result, len(checks))
+	for name, checker := range checks {
+		go func(name string, checker Checker) {
+			results <- result{name, checker.Check()}
+		}(name, checker)
+	}
+
+	status := HealthStatus{Status: HealthOK, Checks: make(map[string]map[string]interface{}, len(checks))}
+	for name := range checks {
+		status.Checks[name] = map[string]interface{}{"status": HealthFail, "error": "timed out"}
+	}
+
+	timeout := time.After(h.timeout())
+wait:
+	for i := 0; i < len(checks); i++ {
+		select {
+		case r := <-results:
+			check := map[string]interface{}{"status": HealthOK}
+			if r.err != nil {
+				check = map[string]interface{}{"status": HealthFail, "error": r.err.Error()}
+			}
+			status.Checks[r.name] = check
+		case <-timeout:
+			break wait
+		}
+	}
+
+	for name, checker := range checks {
+		if detailed, ok := checker.(detailedChecker); ok {
+			for key, value := range detailed.HealthDetails() {
+				status.Checks[name][key] = value
+			}
+		}
+		if status.Checks[name]["status"] != HealthOK {
+			status.Status = HealthUnavailable
+		}
+	}
+	return status
+}
+
+func (h Health) handler(checks map[string]Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		status := h.run(checks)
+		code := http.StatusOK
+		if status.Status != HealthOK {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// LiveHandler serves /healthz.
+func (h Health) LiveHandler() http.HandlerFunc {
+	return h.handler(h.Live)
+}
+
+// ReadyHandler serves /readyz.
+func (h Health) ReadyHandler() http.HandlerFunc {
+	return h.handler(h.Ready)
+}
@@ -0,0 +1,115 @@
+package podd_service_notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serveHealth(handler http.HandlerFunc) (int, HealthStatus) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+	var status HealthStatus
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	return rr.Code, status
+}
+
+func TestHealthReady(t *testing.T) {
+	server := Server{Cache: NewMemoryCache()}
+	subscriber := &SubscriberHealth{MaxDown: 20 * time.Millisecond}
+
+	health := Health{
+		Live: map[string]Checker{"subscriber": subscriber.Live()},
+		Ready: map[string]Checker{
+			"cache": server.CacheCheck(),
+			"subscriber": subscriber,
+			"db": CheckFunc(func() error { return nil }),
+		},
+	}
+
+	code, status := serveHealth(health.ReadyHandler())
+	if code != http.StatusServiceUnavailable || status.Checks["subscriber"]["status"] != HealthFail || status.Checks["cache"]["status"] != HealthOK {
+		t.Errorf("must not be ready before subscribing, got %d %v", code, status)
+	}
+
+	subscriber.Subscribed()
+	subscriber.Received()
+	code, status = serveHealth(health.ReadyHandler())
+	if code != http.StatusOK || status.Status != HealthOK {
+		t.Errorf("must be ready once subscribed, got %d %v", code, status)
+	}
+	if _, ok := status.Checks["subscriber"]["lastMessage"]; !ok {
+		t.Errorf("subscriber check must report last message time, got %v", status.Checks["subscriber"])
+	}
+
+	subscriber.Failed(errors.New("connection reset"))
+	code, status = serveHealth(health.ReadyHandler())
+	if code != http.StatusServiceUnavailable || status.Checks["subscriber"]["error"] != "subscriber stopped: connection reset" {
+		t.Errorf("must not be ready once subscriber stopped, got %d %v", code, status)
+	}
+	if code, _ = serveHealth(health.LiveHandler()); code != http.StatusOK {
+		t.Errorf("reconnecting subscriber must stay live, got %d", code)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	subscriber.Failed(errors.New("connection refused"))
+	code, status = serveHealth(health.LiveHandler())
+	if code != http.StatusServiceUnavailable || status.Checks["subscriber"]["status"] != HealthFail {
+		t.Errorf("subscriber down for longer than max down must not be live, got %d %v", code, status)
+	}
+}
+
+func TestHealthTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	health := Health{
+		Ready: map[string]Checker{
+			"api": CheckFunc(func() error { <-block; return nil }),
+		},
+		Timeout: 10 * time.Millisecond,
+	}
+
+	code, status := serveHealth(health.ReadyHandler())
+	if code != http.StatusServiceUnavailable || status.Checks["api"]["error"] != "timed out" {
+		t.Errorf("slow check must fail, got %d %v", code, status)
+	}
+}
+
+func TestSubscriberHealthMaxSilence(t *testing.T) {
+	subscriber := &SubscriberHealth{MaxSilence: 10 * time.Millisecond}
+	subscriber.Subscribed()
+
+	if err := subscriber.Check(); err != nil {
+		t.Errorf("fresh subscription must be healthy, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := subscriber.Check(); err == nil {
+		t.Errorf("subscriber without messages for longer than max silence must be unhealthy")
+	}
+	subscriber.Received()
+	if err := subscriber.Check(); err != nil {
+		t.Errorf("message must make subscriber healthy again, got %v", err)
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	code := http.StatusOK
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer api.Close()
+
+	check := HTTPCheck{URL: api.URL}
+	if err := check.Check(); err != nil {
+		t.Errorf("api answering must be healthy, got %v", err)
+	}
+	code = http.StatusBadGateway
+	if err := check.Check(); err == nil {
+		t.Errorf("api answering 5xx must be unhealthy")
+	}
+}
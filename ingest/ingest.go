@@ -0,0 +1,100 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	PoddService "github.com/openpodd/podd-service-notify"
+)
+
+const DefaultChannel = "report:new"
+
+// Config of New, zero values of a consumer are its defaults.
+type Config struct {
+	// auto, stream or pubsub
+	Mode    string
+	Channel string
+
+	Stream string
+	// every program reading the stream needs its own group, a group shares
+	// the events among its consumers
+	Group string
+	// hostname when empty
+	Consumer      string
+	StartId       string
+	Block         time.Duration
+	ClaimIdle     time.Duration
+	MaxDeliveries int
+
+	PingInterval time.Duration
+	Backoff      PoddService.Backoff
+}
+
+func (c Config) channel() string {
+	if c.Channel == "" {
+		return DefaultChannel
+	}
+	return c.Channel
+}
+
+// New makes the Ingester of config.Mode, auto falls back to pub/sub for a
+// PODD that does not add report events to the stream yet.
+func New(pool *redis.Pool, dial func() (redis.Conn, error), config Config, handler MessageHandler, quarantine Quarantine, health *PoddService.SubscriberHealth, logger *PoddService.Logger) (Ingester, error) {
+	mode := config.Mode
+	if mode == "auto" {
+		conn := pool.Get()
+		keyType, err := redis.String(conn.Do("TYPE", config.Stream))
+		conn.Close()
+
+		// events added to the stream meanwhile wait there for a restart
+		mode = "pubsub"
+		if err != nil {
+			logger.With(PoddService.Fields{"error": err}).Warn("Cannot detect ingest mode, using pubsub")
+		} else if keyType == "stream" {
+			mode = "stream"
+		}
+		logger.With(PoddService.Fields{"mode": mode}).Info("Ingest mode detected")
+	}
+
+	switch mode {
+	case "stream":
+		consumer := config.Consumer
+		if consumer == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			consumer = hostname
+		}
+
+		return &StreamConsumer{
+			Dial: dial,
+			Stream: config.Stream,
+			Group: config.Group,
+			Consumer: consumer,
+			StartId: config.StartId,
+			Handler: handler,
+			Quarantine: quarantine,
+			Health: health,
+			Backoff: config.Backoff,
+			Logger: logger.With(PoddService.Fields{"stream": config.Stream, "consumer": consumer}),
+			Block: config.Block,
+			ClaimIdle: config.ClaimIdle,
+			MaxDeliveries: config.MaxDeliveries,
+		}, nil
+	case "pubsub":
+		return &Subscriber{
+			Dial: dial,
+			Channel: config.channel(),
+			Handler: handler,
+			Quarantine: quarantine,
+			Health: health,
+			Backoff: config.Backoff,
+			PingInterval: config.PingInterval,
+			Logger: logger.With(PoddService.Fields{"channel": config.channel()}),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown ingest mode %q", mode)
+}
@@ -0,0 +1,419 @@
+package ingest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	PoddService "github.com/openpodd/podd-service-notify"
+)
+
+const (
+	DefaultStreamBlock     = 5 * time.Second
+	DefaultStreamCount     = 10
+	DefaultClaimIdle       = time.Minute
+	DefaultMaxDeliveries   = 5
+	DefaultStreamDataField = "data"
+	// a new group reads the entries added before it existed
+	DefaultStreamStartId = "0"
+)
+
+// Ingester delivers report events to a MessageHandler until Stop.
+type Ingester interface {
+	Run()
+	Stop()
+}
+
+// StreamConsumer reads a redis stream as a member of a consumer group. An
+// entry is acknowledged once handled, an entry left pending by a failed
+// handler or a dead consumer is claimed again after ClaimIdle.
+type StreamConsumer struct {
+	Dial     func() (redis.Conn, error)
+	Stream   string
+	Group    string
+	// stays the same across restarts so own pending entries are read again
+	Consumer string
+	// field of an entry holding the message
+	Field string
+	// where a new group starts, "0" reads the whole stream and "$" only
+	// entries added after the group is created
+	StartId string
+
+	Handler    MessageHandler
+	Quarantine Quarantine
+	Health     *PoddService.SubscriberHealth
+	Backoff    PoddService.Backoff
+	Logger     PoddService.Entry
+
+	// how long one read waits for new entries, Stop waits as long at most
+	Block time.Duration
+	Count int
+	// pending entries idle for this long are claimed
+	ClaimIdle time.Duration
+	// an entry delivered this often is quarantined
+	MaxDeliveries int
+
+	lock     sync.Mutex
+	stopping bool
+	stop     chan struct{}
+}
+
+type streamEntry struct {
+	Id     string
+	Fields map[string]string
+}
+
+func (c *StreamConsumer) field() string {
+	if c.Field == "" {
+		return DefaultStreamDataField
+	}
+	return c.Field
+}
+
+func (c *StreamConsumer) startId() string {
+	if c.StartId == "" {
+		return DefaultStreamStartId
+	}
+	return c.StartId
+}
+
+func (c *StreamConsumer) block() time.Duration {
+	if c.Block == 0 {
+		return DefaultStreamBlock
+	}
+	return c.Block
+}
+
+func (c *StreamConsumer) count() int {
+	if c.Count == 0 {
+		return DefaultStreamCount
+	}
+	return c.Count
+}
+
+func (c *StreamConsumer) claimIdle() time.Duration {
+	if c.ClaimIdle == 0 {
+		return DefaultClaimIdle
+	}
+	return c.ClaimIdle
+}
+
+func (c *StreamConsumer) maxDeliveries() int64 {
+	if c.MaxDeliveries == 0 {
+		return DefaultMaxDeliveries
+	}
+	return int64(c.MaxDeliveries)
+}
+
+func (c *StreamConsumer) stopChan() chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stop == nil {
+		c.stop = make(chan struct{})
+	}
+	return c.stop
+}
+
+func (c *StreamConsumer) stopped() bool {
+	select {
+	case <-c.stopChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// Run consumes until Stop.
+func (c *StreamConsumer) Run() {
+	stop := c.stopChan()
+
+	for {
+		err := c.consume()
+		if err == nil {
+			c.Logger.Info("Stopped consuming")
+			return
+		}
+
+		c.Health.Failed(err)
+		wait := c.Backoff.Next()
+		c.Logger.Error("Stream consumer failed, reconnecting", PoddService.Fields{"error": err, "wait": wait.String()})
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Stop after the entries being handled, a blocked read ends within Block.
+func (c *StreamConsumer) Stop() {
+	stop := c.stopChan()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.stopping {
+		c.stopping = true
+		close(stop)
+	}
+}
+
+// consume on one connection, nil error means stopped
+func (c *StreamConsumer) consume() error {
+	conn, err := c.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("XGROUP", "CREATE", c.Stream, c.Group, c.startId(), "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	c.Health.Subscribed()
+	c.Backoff.Reset()
+
+	// entries read before a restart but never acknowledged
+	for id := "0"; ; {
+		entries, err := c.read(conn, id, 0)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		c.handle(conn, entries)
+		id = entries[len(entries) - 1].Id
+	}
+
+	lastClaim := time.Now()
+	for !c.stopped() {
+		if time.Since(lastClaim) > c.claimIdle() / 2 {
+			if err := c.claim(conn); err != nil {
+				return err
+			}
+			lastClaim = time.Now()
+		}
+
+		entries, err := c.read(conn, ">", c.block())
+		if err != nil {
+			return err
+		}
+		c.handle(conn, entries)
+	}
+	return nil
+}
+
+// read entries of the group after id, ">" reads new ones and blocks
+func (c *StreamConsumer) read(conn redis.Conn, id string, block time.Duration) ([]streamEntry, error) {
+	args := redis.Args{"GROUP", c.Group, c.Consumer, "COUNT", c.count()}
+	if block > 0 {
+		args = args.Add("BLOCK", int64(block / time.Millisecond))
+	}
+	args = args.Add("STREAMS", c.Stream, id)
+
+	reply, err := redis.Values(conn.Do("XREADGROUP", args...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// one stream was read, its reply is [name, entries]
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	stream, err := redis.Values(reply[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected XREADGROUP reply %v", reply)
+	}
+	return parseStreamEntries(stream[1])
+}
+
+// entries of XREADGROUP and XCLAIM, [[id, [field, value, ...]], ...]
+func parseStreamEntries(reply interface{}) ([]streamEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(values))
+	for _, value := range values {
+		// a deleted entry of XCLAIM is nil
+		if value == nil {
+			continue
+		}
+		parts, err := redis.Values(value, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", value)
+		}
+
+		id, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		// a deleted entry still pending has nil fields
+		fields, err := redis.StringMap(parts[1], nil)
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		entries = append(entries, streamEntry{Id: id, Fields: fields})
+	}
+	return entries, nil
+}
+
+// id right after id, so XPENDING can page without the exclusive range of
+// redis 6.2
+func nextStreamId(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+
+	if seq == math.MaxUint64 {
+		return strconv.FormatUint(ms + 1, 10) + "-0", nil
+	}
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq + 1, 10), nil
+}
+
+// claim entries pending for longer than ClaimIdle, page by page through the
+// whole pending list, an entry delivered too often is quarantined instead
+func (c *StreamConsumer) claim(conn redis.Conn) error {
+	for start := "-"; ; {
+		pending, err := redis.Values(conn.Do("XPENDING", c.Stream, c.Group, start, "+", c.count()))
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		last, err := c.claimPage(conn, pending)
+		if err != nil {
+			return err
+		}
+		if len(pending) < c.count() || c.stopped() {
+			return nil
+		}
+		if start, err = nextStreamId(last); err != nil {
+			return err
+		}
+	}
+}
+
+// claim idle entries of one XPENDING page, returns the last id of the page
+func (c *StreamConsumer) claimPage(conn redis.Conn, pending []interface{}) (string, error) {
+	idle := int64(c.claimIdle() / time.Millisecond)
+	var ids []interface{}
+	var last string
+	for _, p := range pending {
+		// [id, consumer, idle ms, deliveries]
+		info, err := redis.Values(p, nil)
+		if err != nil || len(info) != 4 {
+			return "", fmt.Errorf("unexpected XPENDING entry %v", p)
+		}
+		id, _ := redis.String(info[0], nil)
+		entryIdle, _ := redis.Int64(info[2], nil)
+		deliveries, _ := redis.Int64(info[3], nil)
+		last = id
+
+		if entryIdle < idle {
+			continue
+		}
+		if deliveries >= c.maxDeliveries() {
+			c.quarantine(conn, c.entry(conn, id), fmt.Errorf("delivered %d times", deliveries))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return last, nil
+	}
+
+	args := redis.Args{c.Stream, c.Group, c.Consumer, idle}.Add(ids...)
+	reply, err := conn.Do("XCLAIM", args...)
+	if err != nil {
+		return "", err
+	}
+	entries, err := parseStreamEntries(reply)
+	if err != nil {
+		return "", err
+	}
+
+	PoddService.DefaultMetrics.ReportMessages.WithLabelValues("claimed").Add(float64(len(entries)))
+	c.Logger.Info("Claimed pending entries", PoddService.Fields{"count": len(entries)})
+	c.handle(conn, entries)
+	return last, nil
+}
+
+// entry by id, without fields when it is deleted
+func (c *StreamConsumer) entry(conn redis.Conn, id string) streamEntry {
+	reply, err := conn.Do("XRANGE", c.Stream, id, id)
+	if err != nil {
+		return streamEntry{Id: id}
+	}
+	entries, err := parseStreamEntries(reply)
+	if err != nil || len(entries) == 0 {
+		return streamEntry{Id: id}
+	}
+	return entries[0]
+}
+
+// handle entries, acknowledge the handled ones and leave failed ones
+// pending to be claimed again
+func (c *StreamConsumer) handle(conn redis.Conn, entries []streamEntry) {
+	for _, entry := range entries {
+		c.Health.Received()
+		PoddService.DefaultMetrics.ReportMessages.WithLabelValues("received").Inc()
+
+		data, ok := entry.Fields[c.field()]
+		if !ok {
+			c.quarantine(conn, entry, fmt.Errorf("entry has no %s field", c.field()))
+			continue
+		}
+
+		err := handleMessage(c.Handler, c.Stream, []byte(data))
+		if _, undecodable := err.(UndecodableError); undecodable {
+			c.quarantine(conn, entry, err)
+			continue
+		}
+		if err != nil {
+			c.Logger.Error("Cannot handle entry, left pending", PoddService.Fields{"id": entry.Id, "error": err})
+			continue
+		}
+
+		if _, err := conn.Do("XACK", c.Stream, c.Group, entry.Id); err != nil {
+			c.Logger.Error("Cannot acknowledge entry", PoddService.Fields{"id": entry.Id, "error": err})
+		}
+	}
+}
+
+// quarantine entry and acknowledge it so it is not delivered again
+func (c *StreamConsumer) quarantine(conn redis.Conn, entry streamEntry, reason error) {
+	PoddService.DefaultMetrics.ReportMessages.WithLabelValues("quarantined").Inc()
+	c.Logger.Error("Cannot handle entry, quarantined", PoddService.Fields{"id": entry.Id, "error": reason})
+
+	if c.Quarantine != nil {
+		if err := c.Quarantine.Put(c.Stream, []byte(entry.Fields[c.field()]), reason); err != nil {
+			c.Logger.Error("Cannot quarantine entry, left pending", PoddService.Fields{"id": entry.Id, "error": err})
+			return
+		}
+	}
+	if _, err := conn.Do("XACK", c.Stream, c.Group, entry.Id); err != nil {
+		c.Logger.Error("Cannot acknowledge entry", PoddService.Fields{"id": entry.Id, "error": err})
+	}
+}
@@ -0,0 +1,66 @@
+package ingest
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNextStreamId(t *testing.T) {
+	for id, next := range map[string]string{
+		"1526919030474-0": "1526919030474-1",
+		"1526919030474-55": "1526919030474-56",
+		"1526919030474-18446744073709551615": "1526919030475-0",
+	} {
+		got, err := nextStreamId(id)
+		if err != nil || got != next {
+			t.Errorf("next of %s must be %s, got %s %v", id, next, got, err)
+		}
+	}
+
+	if _, err := nextStreamId("1526919030474"); err == nil {
+		t.Errorf("id without sequence must be invalid")
+	}
+}
+
+func TestParseStreamEntries(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("data"), []byte(`{"id":1}`)}},
+		// deleted by XCLAIM
+		nil,
+		// deleted while pending
+		[]interface{}{[]byte("2-0"), nil},
+	}
+
+	entries, err := parseStreamEntries(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Id != "1-0" || entries[0].Fields["data"] != `{"id":1}` {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	if entries[1].Id != "2-0" || len(entries[1].Fields) != 0 {
+		t.Errorf("deleted entry must have no fields, got %v", entries[1])
+	}
+}
+
+type handlerFunc func(channel string, data []byte) error
+
+func (f handlerFunc) Handle(channel string, data []byte) error {
+	return f(channel, data)
+}
+
+func TestHandleMessage(t *testing.T) {
+	undecodable := handlerFunc(func(channel string, data []byte) error {
+		return UndecodableError{Err: errors.New("unexpected end of JSON input")}
+	})
+	if _, ok := handleMessage(undecodable, "report:new", nil).(UndecodableError); !ok {
+		t.Errorf("undecodable error must be returned as is")
+	}
+
+	panicking := handlerFunc(func(channel string, data []byte) error {
+		panic("nil map")
+	})
+	if err := handleMessage(panicking, "report:new", nil); err == nil || err.Error() != "handler panicked: nil map" {
+		t.Errorf("panic must be returned as error, got %v", err)
+	}
+}
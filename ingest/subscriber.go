@@ -0,0 +1,253 @@
+// Package ingest delivers report events of a redis pub/sub channel or a redis
+// stream to a handler, shared by the programs reading report:new.
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	PoddService "github.com/openpodd/podd-service-notify"
+)
+
+// MessageHandler handles one pub/sub message, a message it fails is
+// quarantined instead of being lost.
+type MessageHandler interface {
+	Handle(channel string, data []byte) error
+}
+
+// UndecodableError is a message no retry can handle, it is quarantined at once.
+type UndecodableError struct {
+	Err error
+}
+
+func (e UndecodableError) Error() string {
+	return "cannot decode message: " + e.Err.Error()
+}
+
+// handle message by handler, a panic is returned as error
+func handleMessage(handler MessageHandler, channel string, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return handler.Handle(channel, data)
+}
+
+// Quarantine keeps messages that could not be handled for a later look.
+type Quarantine interface {
+	Put(channel string, data []byte, reason error) error
+}
+
+// RedisQuarantine pushes messages onto a capped redis list, newest first.
+type RedisQuarantine struct {
+	Pool *redis.Pool
+	Key  string
+	// longest length of the list
+	Max int
+}
+
+type quarantinedMessage struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Data    string    `json:"data"`
+	Reason  string    `json:"reason"`
+}
+
+func (q RedisQuarantine) Put(channel string, data []byte, reason error) error {
+	entry, err := json.Marshal(quarantinedMessage{
+		Time: time.Now().UTC(),
+		Channel: channel,
+		Data: string(data),
+		Reason: reason.Error(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn := q.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("LPUSH", q.Key, entry)
+	conn.Send("LTRIM", q.Key, 0, q.Max - 1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+const DefaultPingInterval = 30 * time.Second
+
+// Subscriber receives a pub/sub channel, it reconnects with backoff when
+// the connection drops and reports its state to Health.
+type Subscriber struct {
+	Dial       func() (redis.Conn, error)
+	Channel    string
+	Handler    MessageHandler
+	Quarantine Quarantine
+	Health     *PoddService.SubscriberHealth
+	Backoff    PoddService.Backoff
+	// the connection is pinged this often, a connection that does not
+	// answer in two intervals is taken as dropped
+	PingInterval time.Duration
+	Logger       PoddService.Entry
+
+	lock     sync.Mutex
+	psc      *redis.PubSubConn
+	stopping bool
+	stop     chan struct{}
+}
+
+func (s *Subscriber) pingInterval() time.Duration {
+	if s.PingInterval == 0 {
+		return DefaultPingInterval
+	}
+	return s.PingInterval
+}
+
+func (s *Subscriber) stopChan() chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	return s.stop
+}
+
+// Run receives until Stop.
+func (s *Subscriber) Run() {
+	stop := s.stopChan()
+
+	for {
+		err := s.receive()
+		if err == nil {
+			s.Logger.Info("Unsubscribed")
+			return
+		}
+
+		s.Health.Failed(err)
+		wait := s.Backoff.Next()
+		s.Logger.Error("Subscriber connection failed, reconnecting", PoddService.Fields{"error": err, "wait": wait.String()})
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Stop unsubscribes, a message being handled is finished first.
+func (s *Subscriber) Stop() {
+	stop := s.stopChan()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopping {
+		return
+	}
+	s.stopping = true
+	close(stop)
+	if s.psc != nil {
+		s.psc.Unsubscribe()
+	}
+}
+
+// subscribe on conn unless stopping, writes to the connection are made
+// under lock so Stop and ping never write at once
+func (s *Subscriber) subscribe(psc *redis.PubSubConn) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopping {
+		return false, nil
+	}
+	if err := psc.Subscribe(s.Channel); err != nil {
+		return false, err
+	}
+	s.psc = psc
+	return true, nil
+}
+
+func (s *Subscriber) ping(psc *redis.PubSubConn, done chan struct{}) {
+	ticker := time.NewTicker(s.pingInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			err := psc.Ping("")
+			s.lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// receive on one connection, nil error means unsubscribed by Stop
+func (s *Subscriber) receive() error {
+	conn, err := s.Dial()
+	if err != nil {
+		return err
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	subscribed, err := s.subscribe(psc)
+	if err != nil || !subscribed {
+		return err
+	}
+	defer func() {
+		s.lock.Lock()
+		s.psc = nil
+		s.lock.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.ping(psc, done)
+
+	for {
+		switch msg := psc.ReceiveWithTimeout(2 * s.pingInterval()).(type) {
+		case redis.Message:
+			s.Health.Received()
+			PoddService.DefaultMetrics.ReportMessages.WithLabelValues("received").Inc()
+			s.handle(msg.Channel, msg.Data)
+		case redis.Subscription:
+			s.Logger.Info("Subscription changed", PoddService.Fields{"kind": msg.Kind, "count": msg.Count})
+			if msg.Kind == "subscribe" {
+				s.Health.Subscribed()
+				s.Backoff.Reset()
+			} else if msg.Kind == "unsubscribe" && msg.Count == 0 {
+				return nil
+			}
+		case redis.Pong:
+		case error:
+			return msg
+		}
+	}
+}
+
+// handle message, a failure or panic of the handler quarantines it
+func (s *Subscriber) handle(channel string, data []byte) {
+	err := handleMessage(s.Handler, channel, data)
+	if err == nil {
+		return
+	}
+
+	PoddService.DefaultMetrics.ReportMessages.WithLabelValues("quarantined").Inc()
+	s.Logger.Error("Cannot handle message, quarantined", PoddService.Fields{"error": err})
+	if s.Quarantine == nil {
+		return
+	}
+	if qerr := s.Quarantine.Put(channel, data, err); qerr != nil {
+		s.Logger.Error("Cannot quarantine message", PoddService.Fields{"error": qerr, "data": string(data)})
+	}
+}
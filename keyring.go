@@ -0,0 +1,95 @@
+package podd_service_notify
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const keyIdSeparator = "."
+
+var ErrUnknownKeyId = errors.New("unknown key id")
+
+// Keyring holds the active cipher which signs new tokens and retired ciphers
+// which still decode outstanding tokens until they expire.
+type Keyring struct {
+	ActiveId string
+	Ciphers  map[string]Cipher
+}
+
+func NewKeyring(activeId string, active Cipher) Keyring {
+	return Keyring{
+		ActiveId: activeId,
+		Ciphers: map[string]Cipher{
+			activeId: active,
+		},
+	}
+}
+
+// ValidateKeyId rejects an id which cannot be told apart in a token header,
+// empty or containing ".".
+func ValidateKeyId(id string) error {
+	if id == "" || strings.Contains(id, keyIdSeparator) {
+		return fmt.Errorf("invalid key id %q, must not be empty or contain %q", id, keyIdSeparator)
+	}
+	return nil
+}
+
+// add retired cipher, its tokens always carry the key id header
+func (k Keyring) Add(id string, c Cipher) error {
+	if err := ValidateKeyId(id); err != nil {
+		return err
+	}
+	k.Ciphers[id] = c
+	return nil
+}
+
+func (k Keyring) Active() (Cipher, error) {
+	c, ok := k.Ciphers[k.ActiveId]
+	if !ok {
+		return Cipher{}, ErrUnknownKeyId
+	}
+
+	return c, nil
+}
+
+// encode with active cipher, token is prefixed with "<key id>." header
+func (k Keyring) EncodePayload(payload Payload) (string, error) {
+	c, err := k.Active()
+	if err != nil {
+		return "", err
+	}
+
+	payloadStr, err := c.EncodePayload(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if k.ActiveId == "" {
+		return payloadStr, nil
+	}
+	return k.ActiveId + keyIdSeparator + payloadStr, nil
+}
+
+func (k Keyring) DecodePayload(payloadStr string) (Payload, error) {
+	parts := strings.SplitN(payloadStr, keyIdSeparator, 2)
+	if len(parts) == 2 {
+		c, ok := k.Ciphers[parts[0]]
+		if !ok {
+			return Payload{}, ErrUnknownKeyId
+		}
+		return c.DecodePayload(parts[1])
+	}
+
+	// token without header, issued before key id, try every key
+	err := ErrUnknownKeyId
+	for _, c := range k.Ciphers {
+		var payload Payload
+		payload, err = c.DecodePayload(payloadStr)
+		if err == nil {
+			return payload, nil
+		}
+	}
+
+	return Payload{}, err
+}
@@ -0,0 +1,77 @@
+package podd_service_notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	oldKeyring := NewKeyring("1", Cipher{Key: "1234567890123456"})
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 10)
+	oldToken, err := oldKeyring.EncodePayload(payload)
+	if err != nil {
+		t.Log("Cannot encode payload", err)
+		t.FailNow()
+	}
+
+	if !strings.HasPrefix(oldToken, "1.") {
+		t.Log("Token must be prefixed with key id", oldToken)
+		t.FailNow()
+	}
+
+	keyring := NewKeyring("2", Cipher{Key: "6543210987654321"})
+	keyring.Add("1", Cipher{Key: "1234567890123456"})
+
+	newToken, _ := keyring.EncodePayload(payload)
+	if !strings.HasPrefix(newToken, "2.") {
+		t.Log("Token must be signed with the active key", newToken)
+		t.FailNow()
+	}
+
+	for _, token := range []string{oldToken, newToken} {
+		decoded, err := keyring.DecodePayload(token)
+		if err != nil || decoded.RefNo != payload.RefNo {
+			t.Log("Cannot decode payload", token, err)
+			t.FailNow()
+		}
+	}
+
+	if _, err := oldKeyring.DecodePayload(newToken); err != ErrUnknownKeyId {
+		t.Log("Token of unknown key id must be rejected", err)
+		t.FailNow()
+	}
+}
+
+func TestKeyringDecodeWithoutKeyId(t *testing.T) {
+	c := Cipher{Key: "1234567890123456"}
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 10)
+	token, _ := c.EncodePayload(payload)
+
+	keyring := NewKeyring("2", Cipher{Key: "6543210987654321"})
+	keyring.Add("1", c)
+
+	decoded, err := keyring.DecodePayload(token)
+	if err != nil || decoded.RefNo != payload.RefNo {
+		t.Log("Token without key id must be decoded with any known key", err)
+		t.FailNow()
+	}
+}
+
+func TestKeyringAddInvalidKeyId(t *testing.T) {
+	keyring := NewKeyring("2", Cipher{Key: "6543210987654321"})
+
+	for _, id := range []string{"", "1.1", "."} {
+		if err := keyring.Add(id, Cipher{Key: "1234567890123456"}); err == nil {
+			t.Errorf("key id %q must be rejected", id)
+		}
+		if _, ok := keyring.Ciphers[id]; ok {
+			t.Errorf("key id %q must not be added", id)
+		}
+	}
+
+	if err := keyring.Add("1", Cipher{Key: "1234567890123456"}); err != nil {
+		t.Error("Cannot add key id 1", err)
+	}
+}
@@ -0,0 +1,158 @@
+package podd_service_notify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+type Fields map[string]interface{}
+
+// Logger writes one JSON object per line with time, level and msg keys
+// next to the fields of the entry.
+type Logger struct {
+	Out   io.Writer
+	Level Level
+
+	lock sync.Mutex
+}
+
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{Out: out, Level: level}
+}
+
+var DefaultLogger = NewLogger(os.Stderr, LevelInfo)
+
+func (l *Logger) Log(level Level, msg string, fields Fields) {
+	if level < l.Level {
+		return
+	}
+
+	line := make(map[string]interface{}, len(fields) + 3)
+	for key, value := range fields {
+		// errors marshal to {}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		line[key] = value
+	}
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"level": LevelError.String(), "msg": "cannot marshal log line", "error": err.Error()})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.Out.Write(append(data, '\n'))
+}
+
+func (l *Logger) With(fields Fields) Entry {
+	return Entry{logger: l, fields: fields}
+}
+
+// Entry logs with fields shared by a request.
+type Entry struct {
+	logger *Logger
+	fields Fields
+}
+
+// entry with fields added to the shared ones
+func (e Entry) With(fields Fields) Entry {
+	merged := make(Fields, len(e.fields) + len(fields))
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return Entry{logger: e.logger, fields: merged}
+}
+
+func (e Entry) log(level Level, msg string, fields []Fields) {
+	if len(fields) > 0 {
+		e = e.With(fields[0])
+	}
+	e.logger.Log(level, msg, e.fields)
+}
+
+func (e Entry) Debug(msg string, fields ...Fields) { e.log(LevelDebug, msg, fields) }
+func (e Entry) Info(msg string, fields ...Fields)  { e.log(LevelInfo, msg, fields) }
+func (e Entry) Warn(msg string, fields ...Fields)  { e.log(LevelWarn, msg, fields) }
+func (e Entry) Error(msg string, fields ...Fields) { e.log(LevelError, msg, fields) }
+
+func (s Server) logger() *Logger {
+	if s.Logger == nil {
+		return DefaultLogger
+	}
+	return s.Logger
+}
+
+const RequestIdHeader = "X-Request-Id"
+
+type requestIdContextKey struct{}
+
+// RequestId of request, empty before withRequestId
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdContextKey{}).(string)
+	return id
+}
+
+// keep request id of an earlier middleware or the proxy, otherwise create one,
+// it is sent back so a user report can be matched with the logs
+func withRequestId(w http.ResponseWriter, r *http.Request) *http.Request {
+	if RequestId(r) != "" {
+		return r
+	}
+
+	id := r.Header.Get(RequestIdHeader)
+	if id == "" || len(id) > 64 {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(RequestIdHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIdContextKey{}, id))
+}
+
+// logger of a request, the path carries the link so it is not logged
+func (s Server) requestLog(r *http.Request) Entry {
+	return s.logger().With(Fields{"requestId": RequestId(r), "method": r.Method})
+}
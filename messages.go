@@ -0,0 +1,187 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"strings"
+)
+
+// user-facing message keys
+const (
+	MessageWrongAction = "wrong_action"
+	MessagePending     = "pending"
+	MessageTryAgain    = "try_again"
+	MessageRejected    = "rejected"
+	MessageInvalidForm = "invalid_form"
+	MessageInvalidCSRF = "invalid_csrf"
+
+	MessageForbiddenOrigin = "forbidden_origin"
+	MessageTooManyRequests = "too_many_requests"
+
+	// form field errors
+	MessageRequired      = "required"
+	MessageInvalidOption = "invalid_option"
+	MessageInvalidNumber = "invalid_number"
+
+	// pages
+	MessageSubmit             = "submit"
+	MessageVerifyThankyou     = "verify_thankyou"
+	MessageZeroReportThankyou = "zero_report_thankyou"
+	MessageExpired            = "expired"
+	MessageProcessed          = "processed"
+	MessageReissue            = "reissue"
+	MessageReissued           = "reissued"
+	MessageReissueLimited     = "reissue_limited"
+	MessageReportClosed       = "report_closed"
+
+	// push messages
+	MessageGCMVerifyReported = "gcm_verify_reported"
+	MessageGCMVerifyRequest  = "gcm_verify_request"
+	MessageGCMVerifyNote     = "gcm_verify_note"
+	MessageZeroReportPrompt  = "zero_report_prompt"
+	MessageZeroReportButton  = "zero_report_button"
+)
+
+const DefaultLocale = "th"
+
+// claim of user locale, set from user profile when the link is minted
+const ClaimLocale = "locale"
+
+// messages by locale, a key missing in a locale falls back to DefaultLocale
+var Catalog = map[string]map[string]string{
+	"th": {
+		MessageWrongAction: "ลิงก์นี้ไม่สามารถใช้กับรายการนี้ได้ค่ะ",
+		MessagePending:     "กำลังดำเนินการ กรุณาลองใหม่อีกครั้งค่ะ",
+		MessageTryAgain:    "ระบบขัดข้อง กรุณาลองใหม่อีกครั้งค่ะ",
+		MessageRejected:    "ไม่สามารถดำเนินการตามลิงก์นี้ได้ค่ะ",
+		MessageInvalidForm: "กรุณาตอบคำถามให้ครบถ้วนค่ะ",
+		MessageInvalidCSRF: "แบบฟอร์มหมดเวลา กรุณากดยืนยันอีกครั้งค่ะ",
+
+		MessageForbiddenOrigin: "ไม่สามารถส่งข้อมูลจากหน้านี้ได้ค่ะ",
+		MessageTooManyRequests: "มีการใช้งานถี่เกินไป กรุณารอสักครู่แล้วลองใหม่ค่ะ",
+
+		MessageRequired:      "กรุณาตอบคำถามนี้",
+		MessageInvalidOption: "กรุณาเลือกจากตัวเลือกด้านบน",
+		MessageInvalidNumber: "กรุณาระบุเป็นตัวเลข",
+
+		MessageSubmit:             "ยืนยันข้อมูล",
+		MessageVerifyThankyou:     "ขอบคุณสำหรับการยืนยันรายงานค่ะ",
+		MessageZeroReportThankyou: "ขอบคุณสำหรับการรายงานค่ะ",
+		MessageExpired:            "ลิงก์นี้หมดอายุแล้วค่ะ",
+		MessageProcessed:          "ได้รับข้อมูลของท่านแล้ว ขอบคุณค่ะ",
+		MessageReissue:            "ขอลิงก์ใหม่",
+		MessageReissued:           "ส่งลิงก์ใหม่ไปยังเครื่องของท่านแล้วค่ะ",
+		MessageReissueLimited:     "ส่งลิงก์ใหม่ไปแล้ว กรุณาตรวจสอบการแจ้งเตือน หรือลองใหม่ภายหลังค่ะ",
+		MessageReportClosed:       "รายงานนี้ปิดแล้ว ไม่ต้องดำเนินการใดๆ ค่ะ",
+
+		MessageGCMVerifyReported: "ตามที่อาสาได้รายงาน",
+		MessageGCMVerifyRequest:  "กรุณากรอกข้อมูลเพื่อยืนยันรายงาน",
+		MessageGCMVerifyNote:     "(เมื่อยืนยันแล้ว กรณีที่เป็นจริง ระบบจะทำการส่งข้อมูลแจ้งเตือนไปยัง ปศุสัตว์อำเภอ/จังหวัด และ องค์การปกครองส่วนท้องถิ่น)",
+		MessageZeroReportPrompt:  "กดลิ้งค์เพื่อรายงาน",
+		MessageZeroReportButton:  "ไม่พบเหตุผิดปกติ",
+	},
+	"en": {
+		MessageWrongAction: "This link cannot be used here.",
+		MessagePending:     "Your submission is being processed, please try again shortly.",
+		MessageTryAgain:    "Something went wrong, please try again.",
+		MessageRejected:    "This link can no longer be used.",
+		MessageInvalidForm: "Please answer all questions.",
+		MessageInvalidCSRF: "The form has timed out, please submit again.",
+
+		MessageForbiddenOrigin: "Answers cannot be submitted from this page.",
+		MessageTooManyRequests: "Too many requests, please wait a moment and try again.",
+
+		MessageRequired:      "Please answer this question.",
+		MessageInvalidOption: "Please choose one of the options above.",
+		MessageInvalidNumber: "Please enter a number.",
+
+		MessageSubmit:             "Submit",
+		MessageVerifyThankyou:     "Thank you for verifying the report.",
+		MessageZeroReportThankyou: "Thank you for reporting.",
+		MessageExpired:            "This link has expired.",
+		MessageProcessed:          "We have received your answer, thank you.",
+		MessageReissue:            "Send me a new link",
+		MessageReissued:           "A new link has been sent to your device.",
+		MessageReissueLimited:     "A new link was already sent, please check your notifications or try again later.",
+		MessageReportClosed:       "This report is closed, nothing more is needed.",
+
+		MessageGCMVerifyReported: "You reported",
+		MessageGCMVerifyRequest:  "Please fill in the form to verify your report",
+		MessageGCMVerifyNote:     "(Once verified, if the report is real, district/provincial livestock officers and the local administration will be alerted)",
+		MessageZeroReportPrompt:  "Tap to report",
+		MessageZeroReportButton:  "Nothing unusual",
+	},
+	"lo": {
+		MessageWrongAction: "ລິ້ງນີ້ບໍ່ສາມາດໃຊ້ກັບລາຍການນີ້ໄດ້",
+		MessagePending:     "ກຳລັງດຳເນີນການ ກະລຸນາລອງໃໝ່ອີກຄັ້ງ",
+		MessageTryAgain:    "ລະບົບຂັດຂ້ອງ ກະລຸນາລອງໃໝ່ອີກຄັ້ງ",
+		MessageRejected:    "ບໍ່ສາມາດດຳເນີນການຕາມລິ້ງນີ້ໄດ້",
+		MessageInvalidForm: "ກະລຸນາຕອບຄຳຖາມໃຫ້ຄົບຖ້ວນ",
+		MessageInvalidCSRF: "ແບບຟອມໝົດເວລາ ກະລຸນາກົດຢືນຢັນອີກຄັ້ງ",
+
+		MessageForbiddenOrigin: "ບໍ່ສາມາດສົ່ງຂໍ້ມູນຈາກໜ້ານີ້ໄດ້",
+		MessageTooManyRequests: "ມີການໃຊ້ງານຖີ່ເກີນໄປ ກະລຸນາລໍຖ້າຈັກໜ້ອຍແລ້ວລອງໃໝ່",
+
+		MessageRequired:      "ກະລຸນາຕອບຄຳຖາມນີ້",
+		MessageInvalidOption: "ກະລຸນາເລືອກຈາກຕົວເລືອກດ້ານເທິງ",
+		MessageInvalidNumber: "ກະລຸນາລະບຸເປັນຕົວເລກ",
+
+		MessageSubmit:             "ຢືນຢັນຂໍ້ມູນ",
+		MessageVerifyThankyou:     "ຂອບໃຈສຳລັບການຢືນຢັນລາຍງານ",
+		MessageZeroReportThankyou: "ຂອບໃຈສຳລັບການລາຍງານ",
+		MessageExpired:            "ລິ້ງນີ້ໝົດອາຍຸແລ້ວ",
+		MessageProcessed:          "ໄດ້ຮັບຂໍ້ມູນຂອງທ່ານແລ້ວ ຂອບໃຈ",
+		MessageReissue:            "ຂໍລິ້ງໃໝ່",
+		MessageReissued:           "ສົ່ງລິ້ງໃໝ່ໄປຫາເຄື່ອງຂອງທ່ານແລ້ວ",
+		MessageReissueLimited:     "ສົ່ງລິ້ງໃໝ່ໄປແລ້ວ ກະລຸນາກວດເບິ່ງການແຈ້ງເຕືອນ ຫຼື ລອງໃໝ່ພາຍຫຼັງ",
+		MessageReportClosed:       "ລາຍງານນີ້ປິດແລ້ວ ບໍ່ຕ້ອງດຳເນີນການໃດໆ",
+
+		MessageGCMVerifyReported: "ຕາມທີ່ອາສາສະໝັກໄດ້ລາຍງານ",
+		MessageGCMVerifyRequest:  "ກະລຸນາຕື່ມຂໍ້ມູນເພື່ອຢືນຢັນລາຍງານ",
+		MessageGCMVerifyNote:     "(ເມື່ອຢືນຢັນແລ້ວ ຖ້າເປັນຄວາມຈິງ ລະບົບຈະສົ່ງການແຈ້ງເຕືອນໄປຫາ ປົດສັດເມືອງ/ແຂວງ ແລະ ອົງການປົກຄອງທ້ອງຖິ່ນ)",
+		MessageZeroReportPrompt:  "ກົດລິ້ງເພື່ອລາຍງານ",
+		MessageZeroReportButton:  "ບໍ່ພົບເຫດຜິດປົກກະຕິ",
+	},
+}
+
+// return key itself when message is not defined in locale nor DefaultLocale
+func MessageIn(locale string, key string) string {
+	if message, ok := Catalog[locale][key]; ok {
+		return message
+	}
+	if message, ok := Catalog[DefaultLocale][key]; ok {
+		return message
+	}
+	return key
+}
+
+func Message(key string) string {
+	return MessageIn(DefaultLocale, key)
+}
+
+// return supported locale of a language tag like "en-US", empty when unsupported
+func SupportedLocale(tag string) string {
+	locale := strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(locale, "-_;"); i >= 0 {
+		locale = locale[:i]
+	}
+	if _, ok := Catalog[locale]; ok {
+		return locale
+	}
+	return ""
+}
+
+// locale of payload claim, then Accept-Language, then DefaultLocale
+func RequestLocale(payload Payload, r *http.Request) string {
+	if locale := SupportedLocale(payload.Claim(ClaimLocale)); locale != "" {
+		return locale
+	}
+
+	// languages are listed by preference, q values are ignored
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		if locale := SupportedLocale(tag); locale != "" {
+			return locale
+		}
+	}
+
+	return DefaultLocale
+}
@@ -0,0 +1,85 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageIn(t *testing.T) {
+	if MessageIn("en", MessageExpired) != Catalog["en"][MessageExpired] {
+		t.Errorf("message must be of requested locale")
+	}
+	if MessageIn("fr", MessageExpired) != Catalog[DefaultLocale][MessageExpired] {
+		t.Errorf("unsupported locale must fall back to default locale")
+	}
+	if MessageIn("en", "no_such_key") != "no_such_key" {
+		t.Errorf("unknown key must render as the key itself")
+	}
+}
+
+func TestRequestLocale(t *testing.T) {
+	tests := []struct {
+		claim          string
+		acceptLanguage string
+		want           string
+	}{
+		{"", "", DefaultLocale},
+		{"", "fr-FR, en-US;q=0.8", "en"},
+		{"", "lo", "lo"},
+		{"", "fr", DefaultLocale},
+		{"lo", "en-US", "lo"},
+		{"fr", "en", "en"},
+	}
+
+	for _, test := range tests {
+		payload := Payload{}
+		if test.claim != "" {
+			payload.SetClaim(ClaimLocale, test.claim)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", test.acceptLanguage)
+
+		if locale := RequestLocale(payload, req); locale != test.want {
+			t.Errorf("claim %q, Accept-Language %q: got %q want %q", test.claim, test.acceptLanguage, locale, test.want)
+		}
+	}
+}
+
+func TestVerifyReportHandlerLocale(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+	}
+	handler := http.HandlerFunc(server.VerifyReportHandler(nil))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	if !strings.Contains(body, "Confirm that the report is real") || !strings.Contains(body, MessageIn("en", MessageSubmit)) {
+		t.Errorf("form must be rendered in locale of Accept-Language")
+	}
+
+	// profile locale minted into the link wins over the browser
+	payload.SetClaim(ClaimLocale, "lo")
+	payloadStr, _ = server.Keyring.EncodePayload(payload)
+	req, _ = http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "isVerified=1&isOutbreak=0")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "en")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), MessageIn("lo", MessageVerifyThankyou)) {
+		t.Errorf("done page must be rendered in locale of token claim, got %q", rr.Body.String())
+	}
+}
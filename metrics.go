@@ -0,0 +1,109 @@
+package podd_service_notify
+
+import (
+	"net/http"
+
+	"github.com/alexjlockwood/gcm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of the notify services, shared by the server, fridaynotice and
+// broadcast_via_gcm so dashboards can follow a link from send to submit.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	// links minted into a push message, by action
+	LinksIssued *prometheus.CounterVec
+	// handler responses by action and status of APIResponse, e.g. a GET
+	// answered ok is an opened link, expired is a link used too late
+	HandlerResponses *prometheus.CounterVec
+	HandlerDuration  *prometheus.HistogramVec
+	// action callbacks, i.e. calls to PODD API, by action and ok, retry or reject
+	CallbackDuration *prometheus.HistogramVec
+	// report:new messages by stage: received, filtered, notified or error
+	ReportMessages *prometheus.CounterVec
+	// devices a push message was sent to, by success or failure
+	SenderDevices *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	r := prometheus.NewRegistry()
+	factory := promauto.With(r)
+	return &Metrics{
+		Registry: r,
+		LinksIssued: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "podd_notify_links_issued_total",
+			Help: "Links minted into push messages.",
+		}, []string{"action"}),
+		HandlerResponses: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "podd_notify_handler_responses_total",
+			Help: "Responses of link handlers by outcome.",
+		}, []string{"action", "outcome"}),
+		HandlerDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "podd_notify_handler_duration_seconds",
+			Help: "Time to answer a link request.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"action"}),
+		CallbackDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "podd_notify_callback_duration_seconds",
+			Help: "Time of action callbacks to PODD API by result.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"action", "result"}),
+		ReportMessages: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "podd_notify_report_messages_total",
+			Help: "report:new messages by stage.",
+		}, []string{"stage"}),
+		SenderDevices: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "podd_notify_sender_devices_total",
+			Help: "Devices a push message was sent to by result.",
+		}, []string{"result"}),
+	}
+}
+
+// Handler serves the metrics to a prometheus scrape.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// WriteFile writes the metrics for the textfile collector of node_exporter,
+// the file is replaced at once so a scrape never reads half of it.
+func (m *Metrics) WriteFile(path string) error {
+	return prometheus.WriteToTextfile(path, m.Registry)
+}
+
+var DefaultMetrics = NewMetrics()
+
+// ObserveSend counts the devices of a push message by the sender response
+func (m *Metrics) ObserveSend(response *gcm.Response, err error, devices int) {
+	if err != nil {
+		failed := devices
+		if response != nil {
+			failed = response.Failure
+		}
+		m.SenderDevices.WithLabelValues("failure").Add(float64(failed))
+		return
+	}
+
+	m.SenderDevices.WithLabelValues("success").Add(float64(response.Success))
+	m.SenderDevices.WithLabelValues("failure").Add(float64(response.Failure))
+}
+
+// callback result label
+func resultLabel(result Result) string {
+	if result.Success() {
+		return "ok"
+	}
+	if result.Retryable {
+		return "retry"
+	}
+	return "reject"
+}
+
+func (s Server) metrics() *Metrics {
+	if s.Metrics == nil {
+		return DefaultMetrics
+	}
+	return s.Metrics
+}
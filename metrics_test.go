@@ -0,0 +1,119 @@
+package podd_service_notify
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexjlockwood/gcm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observations of a histogram series
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.HandlerResponses.WithLabelValues(ActionVerifyReport, StatusOK).Inc()
+	m.HandlerDuration.WithLabelValues(ActionVerifyReport).Observe(0.05)
+
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("metrics must be in prometheus text format, got %s", rr.Header().Get("Content-Type"))
+	}
+
+	for _, line := range []string{
+		`podd_notify_handler_responses_total{action="verify",outcome="ok"} 1`,
+		`podd_notify_handler_duration_seconds_bucket{action="verify",le="0.1"} 1`,
+		`podd_notify_handler_duration_seconds_count{action="verify"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), line) {
+			t.Errorf("exposition must contain %s, got:\n%s", line, rr.Body.String())
+		}
+	}
+}
+
+func TestMetricsWriteFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metrics")
+	defer os.RemoveAll(dir)
+
+	m := NewMetrics()
+	m.LinksIssued.WithLabelValues(ActionZeroReport).Inc()
+
+	path := filepath.Join(dir, "fridaynotice.prom")
+	if err := m.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(data), `podd_notify_links_issued_total{action="zero"} 1`) {
+		t.Errorf("file must hold the metrics, got %s", data)
+	}
+}
+
+func TestMetricsObserveSend(t *testing.T) {
+	m := NewMetrics()
+
+	m.ObserveSend(&gcm.Response{Success: 3, Failure: 1}, nil, 4)
+	m.ObserveSend(nil, errors.New("unavailable"), 2)
+
+	success := testutil.ToFloat64(m.SenderDevices.WithLabelValues("success"))
+	failure := testutil.ToFloat64(m.SenderDevices.WithLabelValues("failure"))
+	if success != 3 || failure != 3 {
+		t.Errorf("devices must be counted by result, got %v success %v failure", success, failure)
+	}
+}
+
+func TestActionHandlerMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+		Metrics: metrics,
+	}
+
+	var count int32
+	handler := http.HandlerFunc(server.VerifyReportHandler(CountingCallback{Count: &count}))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	expired, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -time.Second)
+	expiredStr, _ := server.Keyring.EncodePayload(expired)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("GET", "/report/verify/" + expiredStr, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "isVerified=0&isOutbreak=1")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for outcome, want := range map[string]float64{StatusOK: 2, StatusExpired: 1} {
+		if got := testutil.ToFloat64(metrics.HandlerResponses.WithLabelValues(ActionVerifyReport, outcome)); got != want {
+			t.Errorf("%s responses: got %v want %v", outcome, got, want)
+		}
+	}
+	if sampleCount(t, metrics.HandlerDuration.WithLabelValues(ActionVerifyReport)) != 3 {
+		t.Errorf("every response must be timed")
+	}
+	if sampleCount(t, metrics.CallbackDuration.WithLabelValues(ActionVerifyReport, "ok")) != 1 {
+		t.Errorf("callback must be timed by result")
+	}
+}
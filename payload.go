@@ -11,11 +11,59 @@ import (
 	"io"
 	"crypto/rand"
 	"net/url"
+	"errors"
+	"encoding/json"
+	"encoding/base64"
 )
 
+type TokenEncoding int
+
+const (
+	EncodingHex TokenEncoding = iota
+	// unpadded base64url, about 2/3 the length of hex
+	EncodingBase64URL
+)
+
+func ParseTokenEncoding(name string) (TokenEncoding, error) {
+	switch name {
+	case "", "hex":
+		return EncodingHex, nil
+	case "base64url":
+		return EncodingBase64URL, nil
+	}
+	return EncodingHex, fmt.Errorf("unknown token encoding %q", name)
+}
+
+func (e TokenEncoding) EncodeToString(src []byte) string {
+	if e == EncodingBase64URL {
+		return base64.RawURLEncoding.EncodeToString(src)
+	}
+	return hex.EncodeToString(src)
+}
+
+// decode text of either encoding, hex is tried first since a hex string is
+// also valid base64url, a wrong guess is caught by the GCM tag check
+func decodeToken(text string) [][]byte {
+	decoded := make([][]byte, 0, 2)
+	if b, err := hex.DecodeString(text); err == nil {
+		decoded = append(decoded, b)
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(text); err == nil {
+		decoded = append(decoded, b)
+	}
+	return decoded
+}
+
 type Cipher struct {
 	Key   string
 	Nonce string
+
+	// encoding of sealed tokens, decoding accepts any encoding
+	Encoding TokenEncoding
+
+	// tokens sealed with the fixed Nonce are accepted until this time,
+	// zero value means legacy tokens are rejected
+	LegacyUntil time.Time
 }
 
 type Payload struct {
@@ -23,22 +71,131 @@ type Payload struct {
 	Expire time.Time
 	Id     int
 	RefNo  string
+	Action string
+	Claims map[string]string
 
-	Form   url.Values
+	Form    url.Values
+	Answers Answers
 }
 
-func (c Cipher) getGCMBlock() (cipher.AEAD, []byte, error) {
+// claim of report type id, selects questionnaire of verify action
+const ClaimReportType = "reportType"
+
+// actions a token can be minted for
+const (
+	ActionZeroReport   = "zero"
+	ActionVerifyReport = "verify"
+)
+
+// first byte of a versioned payload, legacy "token:expire:id:refno" payloads
+// start with a printable character
+const PayloadVersion1 byte = 1
+
+var ErrUnsupportedPayloadVersion = errors.New("unsupported payload version")
+
+// returned by DecodePayload when decrypted payload cannot be parsed
+type MalformedPayloadError struct {
+	Reason string
+}
+
+func (e MalformedPayloadError) Error() string {
+	return "malformed payload: " + e.Reason
+}
+
+type payloadV1 struct {
+	Token  string            `json:"tok"`
+	Expire int64             `json:"exp"`
+	Id     int               `json:"id"`
+	RefNo  string            `json:"ref"`
+	Action string            `json:"act,omitempty"`
+	Claims map[string]string `json:"cl,omitempty"`
+}
+
+func marshalPayload(payload Payload) (string, error) {
+	data, err := json.Marshal(payloadV1{
+		Token: payload.Token,
+		Expire: payload.Expire.Unix(),
+		Id: payload.Id,
+		RefNo: payload.RefNo,
+		Action: payload.Action,
+		Claims: payload.Claims,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(PayloadVersion1) + string(data), nil
+}
+
+func unmarshalPayload(payloadStr string) (Payload, error) {
+	if len(payloadStr) == 0 {
+		return Payload{}, MalformedPayloadError{"empty payload"}
+	}
+
+	version := payloadStr[0]
+	switch {
+	case version == PayloadVersion1:
+		var p payloadV1
+		if err := json.Unmarshal([]byte(payloadStr[1:]), &p); err != nil {
+			return Payload{}, MalformedPayloadError{err.Error()}
+		}
+
+		return Payload{
+			Token: p.Token,
+			Expire: time.Unix(p.Expire, 0),
+			Id: p.Id,
+			RefNo: p.RefNo,
+			Action: p.Action,
+			Claims: p.Claims,
+		}, nil
+	case version < ' ':
+		return Payload{}, ErrUnsupportedPayloadVersion
+	}
+
+	return unmarshalLegacyPayload(payloadStr)
+}
+
+// "token:expire:id:refno"
+func unmarshalLegacyPayload(payloadStr string) (Payload, error) {
+	arr := strings.Split(payloadStr, ":")
+	if len(arr) != 4 {
+		return Payload{}, MalformedPayloadError{fmt.Sprintf("expected 4 fields, got %d", len(arr))}
+	}
+
+	timeInt, err := strconv.ParseInt(arr[1], 10, 64)
+	if err != nil {
+		return Payload{}, MalformedPayloadError{"invalid expire"}
+	}
+
+	id, err := strconv.Atoi(arr[2])
+	if err != nil {
+		return Payload{}, MalformedPayloadError{"invalid id"}
+	}
+
+	return Payload{
+		Token: arr[0],
+		Expire: time.Unix(timeInt, 0),
+		Id: id,
+		RefNo: arr[3],
+	}, nil
+}
+
+func (c Cipher) getGCM() (cipher.AEAD, error) {
 	block, err := aes.NewCipher([]byte(c.Key))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	nonce, err := hex.DecodeString(c.Nonce)
+	return cipher.NewGCM(block)
+}
+
+func (c Cipher) getGCMBlock() (cipher.AEAD, []byte, error) {
+	aesgcm, err := c.getGCM()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	nonce, err := hex.DecodeString(c.Nonce)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -46,6 +203,52 @@ func (c Cipher) getGCMBlock() (cipher.AEAD, []byte, error) {
 	return aesgcm, nonce, nil
 }
 
+// return true when tokens sealed with the fixed Nonce are still accepted
+func (c Cipher) AcceptsLegacy() bool {
+	return c.Nonce != "" && time.Now().Before(c.LegacyUntil)
+}
+
+// Seal encrypts text with a fresh random nonce which is prepended to the cipher text
+func (c Cipher) Seal(text string) (string, error) {
+	aesgcm, err := c.getGCM()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	cipherText := aesgcm.Seal(nonce, nonce, []byte(text), nil)
+	return c.Encoding.EncodeToString(cipherText), nil
+}
+
+// Open decrypts text produced by Seal
+func (c Cipher) Open(sealedText string) (string, error) {
+	aesgcm, err := c.getGCM()
+	if err != nil {
+		return "", err
+	}
+
+	err = errors.New("sealed text is not hex or base64url")
+	for _, byteText := range decodeToken(sealedText) {
+		if len(byteText) < aesgcm.NonceSize() {
+			err = errors.New("sealed text is too short")
+			continue
+		}
+
+		nonce, cipherText := byteText[:aesgcm.NonceSize()], byteText[aesgcm.NonceSize():]
+		var plainText []byte
+		plainText, err = aesgcm.Open(nil, nonce, cipherText, nil)
+		if err == nil {
+			return string(plainText), nil
+		}
+	}
+
+	return "", err
+}
+
 func (c Cipher) Encrypt(text string) (string, error) {
 	aesgcm, nonce, err := c.getGCMBlock()
 	if err != nil {
@@ -59,19 +262,16 @@ func (c Cipher) Encrypt(text string) (string, error) {
 func (c Cipher) Decrypt(encryptedText string) (string, error) {
 	aesgcm, nonce, err := c.getGCMBlock()
 	if err != nil {
-		fmt.Println("Error aesgcm")
 		return "", err
 	}
 
 	byteText, err := hex.DecodeString(encryptedText)
 	if err != nil {
-		fmt.Println("Error convert byte text")
 		return "", err
 	}
 
 	plainText, err := aesgcm.Open(nil, nonce, byteText, nil)
 	if err != nil {
-		fmt.Println("Error Open")
 		return "", err
 	}
 
@@ -79,38 +279,28 @@ func (c Cipher) Decrypt(encryptedText string) (string, error) {
 }
 
 func (c Cipher) EncodePayload(payload Payload) (string, error) {
-	payloadStr := fmt.Sprintf("%s:%d:%d:%s", payload.Token, payload.Expire.Unix(), payload.Id, payload.RefNo)
-	return c.Encrypt(payloadStr)
-}
-
-func (c Cipher) DecodePayload(payloadStr string) (Payload, error) {
-	decrypted, err := c.Decrypt(payloadStr)
+	payloadStr, err := marshalPayload(payload)
 	if err != nil {
-		return Payload{}, err
+		return "", err
 	}
 
-	arr := strings.Split(decrypted, ":")
-	token := arr[0]
-	timeInt, err := strconv.ParseInt(arr[1], 10, 64)
-	if err != nil {
-		return Payload{}, err
-	}
+	return c.Seal(payloadStr)
+}
 
-	expire := time.Unix(timeInt, 0)
-	id, err := strconv.Atoi(arr[2])
+func (c Cipher) DecodePayload(payloadStr string) (Payload, error) {
+	decrypted, err := c.Open(payloadStr)
+	if err != nil && c.AcceptsLegacy() {
+		// link issued before per-token nonce
+		decrypted, err = c.Decrypt(payloadStr)
+	}
 	if err != nil {
 		return Payload{}, err
 	}
 
-	return Payload{
-		Token: token,
-		Expire: expire,
-		Id: id,
-		RefNo: arr[3],
-	}, nil
+	return unmarshalPayload(decrypted)
 }
 
-func CreatePayload(token string, id int, d time.Duration) (Payload, error) {
+func CreatePayload(action string, token string, id int, d time.Duration) (Payload, error) {
 	now := time.Now()
 	expire := now.Add(d)
 
@@ -124,9 +314,39 @@ func CreatePayload(token string, id int, d time.Duration) (Payload, error) {
 		Expire: expire,
 		Id: id,
 		RefNo: hex.EncodeToString(nonce),
+		Action: action,
 	}, nil
 }
 
+// return action payload is minted for, tokens issued before action scoping
+// are zero report tokens when Id is 0 and verify tokens otherwise
+func (p Payload) ActionName() string {
+	if p.Action != "" {
+		return p.Action
+	}
+
+	if p.Id == 0 {
+		return ActionZeroReport
+	}
+	return ActionVerifyReport
+}
+
+func (p Payload) IsFor(action string) bool {
+	return p.ActionName() == action
+}
+
+// return empty string when claim is not set
+func (p Payload) Claim(key string) string {
+	return p.Claims[key]
+}
+
+func (p *Payload) SetClaim(key string, value string) {
+	if p.Claims == nil {
+		p.Claims = make(map[string]string)
+	}
+	p.Claims[key] = value
+}
+
 func (p Payload) IsExpired() bool {
 	now := time.Now()
 	return now.After(p.Expire)
@@ -111,7 +111,7 @@ func TestEncodePayload(t *testing.T) {
 		Nonce: "3a0117f29cd4261bab54b0f1",
 	}
 
-	payload, err := CreatePayload("zsbUIyuvtcAjaXqOFP2ImE3_XsIcSO96y8qPRRFDlAzAdwjTzZA5ekkSEj3tMoeT", 123456, time.Second * 1)
+	payload, err := CreatePayload(ActionVerifyReport, "zsbUIyuvtcAjaXqOFP2ImE3_XsIcSO96y8qPRRFDlAzAdwjTzZA5ekkSEj3tMoeT", 123456, time.Second * 1)
 	if err != nil {
 		t.Log("Cannot create payload", err)
 		t.FailNow()
@@ -136,17 +136,172 @@ func TestEncodePayload(t *testing.T) {
 }
 
 func TestPayload_IsExpired(t *testing.T) {
-	payload, _ := CreatePayload("1234", 1234, -1 * time.Second)
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -1 * time.Second)
 
 	if !payload.IsExpired() {
 		t.Log("Payload must be expired")
 		t.FailNow()
 	}
 
-	payload, _ = CreatePayload("1234", 1234, 10 * time.Second)
+	payload, _ = CreatePayload(ActionVerifyReport, "1234", 1234, 10 * time.Second)
 
 	if payload.IsExpired() {
 		t.Log("Payload must not be expired")
 		t.FailNow()
 	}
-}
\ No newline at end of file
+}
+func TestEncodePayloadFreshNonce(t *testing.T) {
+	c := Cipher{
+		Key: "1234567890123456",
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 10)
+	encoded1, err := c.EncodePayload(payload)
+	if err != nil {
+		t.Log("Cannot encode payload", err)
+		t.FailNow()
+	}
+	encoded2, _ := c.EncodePayload(payload)
+
+	if strings.Compare(encoded1, encoded2) == 0 {
+		t.Log("Same payload must not be encoded to the same token")
+		t.FailNow()
+	}
+
+	decoded, err := c.DecodePayload(encoded2)
+	if err != nil || decoded.RefNo != payload.RefNo {
+		t.Log("Cannot decode payload", err)
+		t.FailNow()
+	}
+}
+
+func TestDecodeLegacyPayload(t *testing.T) {
+	c := Cipher{
+		Key: "1234567890123456",
+		Nonce: "3a0117f29cd4261bab54b0f1",
+	}
+
+	legacy, _ := c.Encrypt(fmt.Sprintf("%s:%d:%d:%s", "1234", time.Now().Add(time.Hour).Unix(), 1234, "abcd"))
+
+	if _, err := c.DecodePayload(legacy); err == nil {
+		t.Log("Legacy payload must be rejected outside migration window")
+		t.FailNow()
+	}
+
+	c.LegacyUntil = time.Now().Add(time.Hour)
+	payload, err := c.DecodePayload(legacy)
+	if err != nil {
+		t.Log("Legacy payload must be accepted inside migration window", err)
+		t.FailNow()
+	}
+	if payload.RefNo != "abcd" {
+		t.Log("RefNo is not correct")
+		t.FailNow()
+	}
+}
+
+func TestEncodePayloadClaims(t *testing.T) {
+	c := Cipher{
+		Key: "1234567890123456",
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "token:with:colons", 1234, time.Second * 10)
+	payload.SetClaim("area", "chiangmai")
+
+	encoded, _ := c.EncodePayload(payload)
+	decoded, err := c.DecodePayload(encoded)
+	if err != nil {
+		t.Log("Cannot decode payload", err)
+		t.FailNow()
+	}
+
+	if decoded.Token != "token:with:colons" || decoded.Id != 1234 || decoded.RefNo != payload.RefNo {
+		t.Log("Decoded payload is not correct", decoded)
+		t.FailNow()
+	}
+
+	if decoded.Claim("area") != "chiangmai" || decoded.Claim("unknown") != "" {
+		t.Log("Decoded claims are not correct", decoded.Claims)
+		t.FailNow()
+	}
+}
+
+func TestDecodeMalformedPayload(t *testing.T) {
+	c := Cipher{
+		Key: "1234567890123456",
+	}
+
+	for _, text := range []string{"", "1234:5678", "1234:abcd:1:ref", string(PayloadVersion1) + "{"} {
+		sealed, _ := c.Seal(text)
+		if _, err := c.DecodePayload(sealed); err == nil {
+			t.Log("Malformed payload must not be decoded", text)
+			t.FailNow()
+		} else if _, ok := err.(MalformedPayloadError); !ok {
+			t.Log("Error must be MalformedPayloadError", err)
+			t.FailNow()
+		}
+	}
+
+	sealed, _ := c.Seal(string([]byte{2}) + "{}")
+	if _, err := c.DecodePayload(sealed); err != ErrUnsupportedPayloadVersion {
+		t.Log("Unknown version must be rejected", err)
+		t.FailNow()
+	}
+}
+
+func TestPayload_IsFor(t *testing.T) {
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 1234, time.Second * 10)
+	if !payload.IsFor(ActionZeroReport) || payload.IsFor(ActionVerifyReport) {
+		t.Log("Payload must be scoped to its action")
+		t.FailNow()
+	}
+
+	// token issued before action scoping
+	legacy := Payload{Token: "1234", Id: 0}
+	if !legacy.IsFor(ActionZeroReport) || legacy.IsFor(ActionVerifyReport) {
+		t.Log("Unscoped payload without report id must be a zero report payload")
+		t.FailNow()
+	}
+
+	legacy.Id = 1234
+	if legacy.IsFor(ActionZeroReport) || !legacy.IsFor(ActionVerifyReport) {
+		t.Log("Unscoped payload with report id must be a verify payload")
+		t.FailNow()
+	}
+}
+
+func TestEncodePayloadBase64URL(t *testing.T) {
+	hexCipher := Cipher{
+		Key: "1234567890123456",
+	}
+	compactCipher := Cipher{
+		Key: "1234567890123456",
+		Encoding: EncodingBase64URL,
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 10)
+	hexEncoded, _ := hexCipher.EncodePayload(payload)
+	compactEncoded, err := compactCipher.EncodePayload(payload)
+	if err != nil {
+		t.Log("Cannot encode payload", err)
+		t.FailNow()
+	}
+
+	if len(compactEncoded) >= len(hexEncoded) {
+		t.Log("Base64url token must be shorter than hex token", compactEncoded)
+		t.FailNow()
+	}
+	if strings.ContainsAny(compactEncoded, "+/=") {
+		t.Log("Base64url token must be url safe and unpadded", compactEncoded)
+		t.FailNow()
+	}
+
+	// decoding detects encoding regardless of cipher setting
+	for _, encoded := range []string{hexEncoded, compactEncoded} {
+		decoded, err := hexCipher.DecodePayload(encoded)
+		if err != nil || decoded.RefNo != payload.RefNo {
+			t.Log("Cannot decode payload", encoded, err)
+			t.FailNow()
+		}
+	}
+}
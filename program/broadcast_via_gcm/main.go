@@ -4,11 +4,18 @@ import (
 	"sync"
 	"log"
 	"encoding/json"
-	"strings"
+	"fmt"
 	"github.com/spf13/viper"
-	"gopkg.in/redis.v3"
+	"github.com/garyburd/redigo/redis"
 	"text/template"
 	"bytes"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	PoddService "github.com/openpodd/podd-service-notify"
+	"github.com/openpodd/podd-service-notify/ingest"
 
 	"database/sql"
 	_ "github.com/lib/pq"
@@ -72,6 +79,17 @@ func init() {
 
 	viper.SetDefault("RedisAddr", "127.0.0.1:6379")
 	viper.SetDefault("RedisDB", 0)
+	viper.SetDefault("MetricsAddr", "")
+
+	// auto reads the stream when it exists at startup, else the channel
+	viper.SetDefault("IngestMode", "auto")
+	viper.SetDefault("StreamKey", "podd:report:new")
+	// not the group of the notify server, both need every report event
+	viper.SetDefault("StreamGroup", "podd-broadcast")
+	viper.SetDefault("StreamConsumer", "")
+	viper.SetDefault("StreamStartId", ingest.DefaultStreamStartId)
+	viper.SetDefault("QuarantineKey", "podd-broadcast:quarantine:report:new")
+	viper.SetDefault("QuarantineMax", 1000)
 
 	viper.SetEnvPrefix("podd")
 	viper.AutomaticEnv()
@@ -91,55 +109,86 @@ func init() {
 }
 
 func main() {
-	redisOptions := redis.Options{
-		Addr: viper.GetString("RedisAddr"),
-		DB:   int64(viper.GetInt("RedisDB")),
+	dial := func() (redis.Conn, error) {
+		return redis.Dial("tcp", viper.GetString("RedisAddr"), redis.DialDatabase(viper.GetInt("RedisDB")))
 	}
-	client := redis.NewClient(&redisOptions)
-	pubsub, err := client.Subscribe("report:new")
+	pool := &redis.Pool{
+		MaxIdle: 3,
+		IdleTimeout: 240 * time.Second,
+		Dial: dial,
+	}
+	defer pool.Close()
+
+	if addr := viper.GetString("MetricsAddr"); addr != "" {
+		go func() {
+			http.Handle("/metrics", PoddService.DefaultMetrics.Handler())
+			log.Println("Metrics server stopped", http.ListenAndServe(addr, nil))
+		}()
+	}
+
+	// a failed report stays pending on the stream, or is quarantined when
+	// it came over pub/sub, instead of stopping the program
+	subscriber, err := ingest.New(pool, dial, ingest.Config{
+		Mode: viper.GetString("IngestMode"),
+		Stream: viper.GetString("StreamKey"),
+		Group: viper.GetString("StreamGroup"),
+		Consumer: viper.GetString("StreamConsumer"),
+		StartId: viper.GetString("StreamStartId"),
+	}, ReportBroadcaster{Pool: pool}, ingest.RedisQuarantine{
+		Pool: pool,
+		Key: viper.GetString("QuarantineKey"),
+		Max: viper.GetInt("QuarantineMax"),
+	}, &PoddService.SubscriberHealth{}, PoddService.DefaultLogger)
 	haltOnErr(err)
 
 	log.Println("Waiting...")
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-
 	go func() {
 		defer wg.Done()
+		subscriber.Run()
+	}()
 
-		for {
-			msg, recErr := pubsub.ReceiveMessage()
-			if recErr != nil {
-				log.Printf("Receive error: %s", recErr)
-			}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("Shutting down on", <-stop)
 
-			dec := json.NewDecoder(strings.NewReader(msg.Payload))
+	subscriber.Stop()
+	wg.Wait()
+}
 
-			var report Report
-			err := dec.Decode(&report)
-			if err != nil {
-				log.Fatal(err)
-			}
+// ReportBroadcaster publishes a news message of an accepted report to the
+// devices of its authority.
+type ReportBroadcaster struct {
+	Pool *redis.Pool
+}
 
-			if !report.TestFlag &&
-				report.IsStateChanged &&
-				report.ParentId == 0 &&
-				report.StateCode == viper.GetString("ReportStateCode") &&
-				report.IsPublic != true {
+func (b ReportBroadcaster) Handle(channel string, data []byte) error {
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return ingest.UndecodableError{Err: err}
+	}
 
-				log.Print("Got new report")
-				log.Printf("  / reportId: %d, reportType: %s, stateCode: %s", report.Id, report.ReportTypeName, report.StateCode)
-				log.Printf("  / Address Text: %s", report.AdministrationAreaAddress)
+	if !report.TestFlag &&
+		report.IsStateChanged &&
+		report.ParentId == 0 &&
+		report.StateCode == viper.GetString("ReportStateCode") &&
+		report.IsPublic != true {
 
-				submit(report, client)
-			}
-		}
-	}()
+		log.Print("Got new report")
+		log.Printf("  / reportId: %d, reportType: %s, stateCode: %s", report.Id, report.ReportTypeName, report.StateCode)
+		log.Printf("  / Address Text: %s", report.AdministrationAreaAddress)
 
-	wg.Wait()
+		return submit(report, b.Pool)
+	}
+	PoddService.DefaultMetrics.ReportMessages.WithLabelValues("filtered").Inc()
+	return nil
 }
 
-func submit(report Report, client *redis.Client) {
+// submit publishes the news message, an error leaves the report to be
+// handled again
+func submit(report Report, pool *redis.Pool) error {
 	log.Print("Submitting...")
 
 	report_id := report.Id
@@ -147,8 +196,8 @@ func submit(report Report, client *redis.Client) {
 	var messageBody bytes.Buffer
 	err := tmpl.Execute(&messageBody, report)
 	if err != nil {
-		log.Print("Fail: Can not make a template, skip.", err)
-		return
+		PoddService.DefaultMetrics.ReportMessages.WithLabelValues("error").Inc()
+		return fmt.Errorf("cannot make message of report %d: %v", report_id, err)
 	}
 
 	// Find all user devices, except reporter's.
@@ -167,8 +216,8 @@ func submit(report Report, client *redis.Client) {
 	`, report.CreatedById, report_id)
 
 	if err != nil {
-		log.Print("Error: Can not get user devices", err, "... skip.")
-		return
+		PoddService.DefaultMetrics.ReportMessages.WithLabelValues("error").Inc()
+		return fmt.Errorf("cannot get user devices of report %d: %v", report_id, err)
 	}
 
 	defer rows.Close()
@@ -198,20 +247,18 @@ func submit(report Report, client *redis.Client) {
 	redisMessage.Message = messageBody.String()
 	redisMessage.ReportId = int64(report_id)
 
-	var encodedMessage []byte
+	var messages [][]byte
 
 	// Android first.
 	if len(gcmRegIds) > 0 {
 		redisMessage.AndroidRegIds = gcmRegIds
 		redisMessage.ApnsRegIds = []string{}
 
-		encodedMessage, err = json.Marshal(redisMessage)
+		encodedMessage, err := json.Marshal(redisMessage)
 		if err != nil {
-			log.Print("Error: ", err, "... skip.")
-			return
+			return err
 		}
-
-		client.Publish("news:new", string(encodedMessage))
+		messages = append(messages, encodedMessage)
 	}
 
 	// Then iOS.
@@ -219,14 +266,38 @@ func submit(report Report, client *redis.Client) {
 		redisMessage.AndroidRegIds = []string{}
 		redisMessage.ApnsRegIds = apnsRegIds
 
-		encodedMessage, err = json.Marshal(redisMessage)
+		encodedMessage, err := json.Marshal(redisMessage)
 		if err != nil {
-			log.Print("Error: ", err, "... skip.")
-			return
+			return err
 		}
+		messages = append(messages, encodedMessage)
+	}
 
-		client.Publish("news:new", string(encodedMessage))
+	if err := publish(pool, messages...); err != nil {
+		return err
 	}
 
+	PoddService.DefaultMetrics.ReportMessages.WithLabelValues("notified").Inc()
 	log.Print("Done.")
+	return nil
+}
+
+// publish messages in one transaction, a report handled again after an
+// error never sends the same message twice
+func publish(pool *redis.Pool, messages ...[]byte) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, message := range messages {
+		conn.Send("PUBLISH", "news:new", message)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("cannot publish news messages: %v", err)
+	}
+	return nil
 }
\ No newline at end of file
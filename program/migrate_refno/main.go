@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/vharitonsky/iniflags"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Moves refNo keys written before key prefix and ttl existed under the prefix
+// and gives them a ttl. Links live at most 7 days so any key older than
+// that plus grace can be dropped by redis.
+//
+// Run it once every server is upgraded, an older server still writes keys
+// without prefix. Until then upgraded servers see those keys through
+// redis.legacyKeys, which can be disabled after the migration.
+
+var (
+	redisHostFlag = flag.String("redis.host", "127.0.0.1", "Redis host")
+	redisPortFlag = flag.Int("redis.port", 6379, "Redis port")
+	redisKeyPrefixFlag = flag.String("redis.keyPrefix", "podd-notify:refno:", "Prefix of refNo keys")
+	ttlFlag = flag.Duration("ttl", 8 * 24 * time.Hour, "TTL of migrated keys, link lifetime plus grace")
+	dryRunFlag = flag.Bool("dryRun", false, "Only print keys to migrate")
+)
+
+// refNo is 12 random bytes in hex
+var refNoPattern = regexp.MustCompile("^[0-9a-f]{24}$")
+
+func main() {
+	iniflags.Parse()
+
+	if *redisKeyPrefixFlag == "" {
+		log.Fatal("redis.keyPrefix is required")
+	}
+
+	conn, err := redis.Dial("tcp", fmt.Sprintf("%s:%d", *redisHostFlag, *redisPortFlag))
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	migrated := 0
+	skipped := 0
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "COUNT", 1000))
+		if err != nil {
+			panic(err)
+		}
+
+		cursor, _ = redis.String(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+
+		for _, key := range keys {
+			if !refNoPattern.MatchString(key) {
+				continue
+			}
+
+			if *dryRunFlag {
+				log.Printf("  / %s -> %s%s", key, *redisKeyPrefixFlag, key)
+				migrated++
+				continue
+			}
+
+			renamed, err := redis.Int(conn.Do("RENAMENX", key, *redisKeyPrefixFlag + key))
+			if err != nil {
+				log.Println("Error renaming", key, err)
+				skipped++
+				continue
+			}
+			if renamed == 0 {
+				// already claimed under prefix
+				conn.Do("DEL", key)
+				skipped++
+				continue
+			}
+
+			if _, err := conn.Do("PEXPIRE", *redisKeyPrefixFlag + key, int64(*ttlFlag / time.Millisecond)); err != nil {
+				log.Println("Error setting ttl", key, err)
+			}
+			migrated++
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	log.Printf("Migrated %d refNo keys, skipped %d keys", migrated, skipped)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	PoddService "github.com/openpodd/podd-service-notify"
+	"github.com/openpodd/podd-service-notify/ingest"
 	"github.com/vharitonsky/iniflags"
 	"flag"
 	"github.com/garyburd/redigo/redis"
@@ -14,24 +17,81 @@ import (
 	"database/sql"
 	_ "github.com/lib/pq"
 	"sync"
+	"os"
+	"os/signal"
+	"syscall"
+	"strconv"
+	"regexp"
+	"sync/atomic"
 )
 
 var (
 	keyFlag = flag.String("key", "1234567890123456", "Key to encrypt/decrypt")
-	nonceFlag = flag.String("nonce", "3a0117f29cd4261bab54b0f1", "Nonce")
+	keyIdFlag = flag.String("key.id", "1", "Id of the active key, embedded in new tokens")
+	keyEncodingFlag = flag.String("key.encoding", "hex", "Encoding of new tokens, hex or base64url")
+	retiredKeysFlag = flag.String("key.retired", "", "Retired keys still accepted on decode, as id=key pairs separated by comma")
+	nonceFlag = flag.String("nonce", "3a0117f29cd4261bab54b0f1", "Nonce of legacy fixed-nonce tokens, empty rejects them")
+	nonceLegacyUntilFlag = flag.String("nonce.legacyUntil", "", "Accept legacy fixed-nonce tokens until this date (YYYY-MM-DD), required with nonce, e.g. the deploy date plus 7 days of link lifetime")
 	redisHostFlag = flag.String("redis.host", "127.0.0.1", "Redis host")
 	redisPortFlag = flag.Int("redis.port", 6379, "Redis port")
+	redisKeyPrefixFlag = flag.String("redis.keyPrefix", "podd-notify:refno:", "Prefix of refNo keys")
+	redisLegacyKeysFlag = flag.Bool("redis.legacyKeys", true, "Also see refNo keys without prefix, disable once migrate_refno has run after every server was upgraded")
+	refNoGraceFlag = flag.Duration("refNo.grace", PoddService.DefaultRefNoGrace, "How long refNo is kept after its link expires")
+	allowedOriginsFlag = flag.String("cors.allowedOrigins", "", "Origins besides this server allowed to read responses and submit forms, separated by comma")
+	csrfKeyFlag = flag.String("csrf.key", "", "HMAC key of form csrf tokens, derived from key when empty")
+	csrfTTLFlag = flag.Duration("csrf.ttl", PoddService.DefaultCSRFTTL, "How long a rendered form can be submitted")
+	rateLimitIPBurstFlag = flag.Int("rateLimit.ip.burst", 60, "Requests a client ip can make at once, 0 disables the limit")
+	rateLimitIPEveryFlag = flag.Duration("rateLimit.ip.every", time.Second, "A client ip gets one more request per this interval")
+	rateLimitTokenBurstFlag = flag.Int("rateLimit.token.burst", 10, "Requests a user token can make at once, 0 disables the limit")
+	rateLimitTokenEveryFlag = flag.Duration("rateLimit.token.every", 6 * time.Second, "A user token gets one more request per this interval")
+	rateLimitRedisFlag = flag.Bool("rateLimit.redis", false, "Share rate limits between servers through redis")
+	rateLimitKeyPrefixFlag = flag.String("rateLimit.keyPrefix", "podd-notify:ratelimit:", "Prefix of rate limit keys in redis")
+	trustForwardedForFlag = flag.Bool("rateLimit.trustForwardedFor", false, "Take client ip from X-Forwarded-For, set behind a reverse proxy")
+	reissueIntervalFlag = flag.Duration("reissue.interval", PoddService.DefaultReissueInterval, "How often a user can request a fresh link for an expired one")
+	refNoPendingTimeoutFlag = flag.Duration("refNo.pendingTimeout", PoddService.DefaultRefNoPendingTimeout, "How long refNo stays pending when its callback never finishes")
 	poddAPIURL = flag.String("api.url", "http://localhost:8000", "PODD API URL")
+	poddAPITimeout = flag.Duration("api.timeout", 15 * time.Second, "Timeout of PODD API requests, must be shorter than refNo.pendingTimeout and shutdown.timeout")
 	poddSharedKey = flag.String("api.sharedKey", "must-override-in-settings-local.py", "PODD Shared Key")
 	gcmAPIKey = flag.String("gcm.key", "local-sample-key", "GCM API Key")
 	acceptedReportTypeId = flag.Int("report.typeId", 0, "Accepted Report Type Id")
 	acceptedReportStateCode = flag.String("report.stateCode", "case", "Accepted Report State Code")
 	dbDSN = flag.String("db.dsn", "user=postgres password=postgres dbname=postgres host=localhost port=5432 sslmode=disable", "Accepted Report State Code")
+	dbLocaleColumnFlag = flag.String("db.localeColumn", "", "Column of accounts_user holding the user's locale (th, en, lo), empty means default locale")
+	questionnairesFlag = flag.String("questionnaires", "", "JSON file of verify questionnaires keyed by report type id or \"default\"")
+	templatesDirFlag = flag.String("templates.dir", "", "Directory of *.html templates overriding the defaults, reloaded on SIGHUP")
+	logLevelFlag = flag.String("log.level", "info", "Lowest level logged: debug, info, warn or error")
+	auditEnabledFlag = flag.Bool("audit.enabled", true, "Record every action attempt into notify_audit")
+	auditBufferFlag = flag.Int("audit.buffer", 1000, "Audit records queued for insert before new ones are dropped")
+	healthTimeoutFlag = flag.Duration("health.timeout", PoddService.DefaultHealthTimeout, "How long each check of /healthz and /readyz may take")
+	healthMaxSilenceFlag = flag.Duration("health.maxSilence", 0, "Not ready when no report:new message came for this long, 0 disables the check")
+	healthAPIURLFlag = flag.String("health.apiUrl", "", "PODD API url checked by /readyz, empty skips the check")
+	shutdownTimeoutFlag = flag.Duration("shutdown.timeout", 20 * time.Second, "How long in-flight requests and the subscriber get to finish on SIGTERM, shutdown.drainDelay plus shutdown.timeout must fit in terminationGracePeriodSeconds (30s by default)")
+	shutdownDrainDelayFlag = flag.Duration("shutdown.drainDelay", 5 * time.Second, "How long /readyz fails before new connections are refused on SIGTERM, longer than the readiness probe period")
+	subscriberBackoffMinFlag = flag.Duration("subscriber.backoffMin", PoddService.DefaultBackoffMin, "First wait before the report:new subscriber reconnects")
+	subscriberBackoffMaxFlag = flag.Duration("subscriber.backoffMax", PoddService.DefaultBackoffMax, "Longest wait before the report:new subscriber reconnects")
+	subscriberPingIntervalFlag = flag.Duration("subscriber.pingInterval", ingest.DefaultPingInterval, "How often the subscriber connection is pinged to find a dropped one")
+	quarantineKeyFlag = flag.String("subscriber.quarantineKey", "podd-notify:quarantine:report:new", "Redis list of report:new messages that could not be handled")
+	quarantineMaxFlag = flag.Int("subscriber.quarantineMax", 1000, "Most messages kept in quarantine")
+	ingestModeFlag = flag.String("ingest.mode", "auto", "Read report events from a redis stream (stream), the report:new channel (pubsub), or the stream when it exists at startup (auto)")
+	streamKeyFlag = flag.String("stream.key", "podd:report:new", "Redis stream of report events")
+	streamGroupFlag = flag.String("stream.group", "podd-notify", "Consumer group of the stream shared by all servers")
+	streamConsumerFlag = flag.String("stream.consumer", "", "Consumer name of this server in the group, hostname when empty")
+	streamStartIdFlag = flag.String("stream.startId", ingest.DefaultStreamStartId, "Where a new consumer group starts, 0 reads events added before it existed, $ only later ones")
+	streamBlockFlag = flag.Duration("stream.block", ingest.DefaultStreamBlock, "How long one stream read waits for new events")
+	streamClaimIdleFlag = flag.Duration("stream.claimIdle", ingest.DefaultClaimIdle, "Events pending for this long are claimed from a failed handler or server")
+	streamMaxDeliveriesFlag = flag.Int("stream.maxDeliveries", ingest.DefaultMaxDeliveries, "Events delivered this often are quarantined")
+	healthMaxDownFlag = flag.Duration("health.maxDown", 5 * time.Minute, "Not live when the subscriber cannot reconnect for this long, 0 disables the check")
+	metricsPathFlag = flag.String("metrics.path", "/metrics", "Path of prometheus metrics, empty disables them")
 	verifyServerUrl = flag.String("verifyServerUrl", "http://localhost:9110/report/verify/", "Verify server url")
 )
 
 type RedisCache struct {
-	Client redis.Conn
+	Pool   *redis.Pool
+	Prefix string
+	// also see refNo keys written without Prefix before it existed, so
+	// links processed by an older server stay processed until
+	// migrate_refno has moved their keys
+	Legacy bool
 }
 
 type DeviceType int
@@ -45,6 +105,8 @@ type User struct {
 	Username string
 	Token    string
 	Device   Device
+	// empty means PoddService.DefaultLocale
+	Locale   string
 }
 
 type Device struct {
@@ -63,57 +125,106 @@ const zeroReport = `
 }
 `
 
-const gcmTemplate = `
-<p>ตามที่อาสาได้รายงาน %s</p>
-<p>
-	<strong><u>กรุณากรอกข้อมูลเพื่อยืนยันรายงาน</u></strong>
-	(เมื่อยืนยันแล้ว กรณีที่เป็นจริง ระบบจะทำการส่งข้อมูลแจ้งเตือนไปยัง ปศุสัตว์อำเภอ/จังหวัด และ องค์การปกครองส่วนท้องถิ่น)
-</p>
-
-<hr style= "border:none;border-top: 1px solid #ccc;"/>
-
-<iframe src="%s" frameborder="0" scrolling="no" width="100%" height="600px">
-</iframe>
-`
+func newKeyring(legacyUntil time.Time) (PoddService.Keyring, error) {
+	encoding, err := PoddService.ParseTokenEncoding(*keyEncodingFlag)
+	if err != nil {
+		return PoddService.Keyring{}, err
+	}
 
-const ThankyouTemplate = `
-<style>
-body {
-    font-family: sans-serif;
-    font-size: 20px;
-    line-height: 1.5em;
-    padding: 5px;
-}
-</style>
-<p>ขอบคุณสำหรับการยืนยันรายงานค่ะ</p>
-`
+	// empty key id signs tokens without header
+	if *keyIdFlag != "" {
+		if err := PoddService.ValidateKeyId(*keyIdFlag); err != nil {
+			return PoddService.Keyring{}, err
+		}
+	}
 
-func createGCMMessageTextForUser(user *User, report *Report) string {
-	cipher := PoddService.Cipher{
+	keyring := PoddService.NewKeyring(*keyIdFlag, PoddService.Cipher{
 		Key: *keyFlag,
 		Nonce: *nonceFlag,
+		Encoding: encoding,
+		LegacyUntil: legacyUntil,
+	})
+
+	if *retiredKeysFlag == "" {
+		return keyring, nil
+	}
+
+	for _, pair := range strings.Split(*retiredKeysFlag, ",") {
+		idKey := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(idKey) != 2 || idKey[0] == *keyIdFlag {
+			return keyring, fmt.Errorf("invalid retired key %q", pair)
+		}
+
+		err := keyring.Add(idKey[0], PoddService.Cipher{
+			Key: idKey[1],
+			Nonce: *nonceFlag,
+			LegacyUntil: legacyUntil,
+		})
+		if err != nil {
+			return keyring, err
+		}
 	}
 
+	return keyring, nil
+}
+
+func createGCMMessageTextForUser(keyring PoddService.Keyring, templates *PoddService.Templates, user *User, report *Report, logger PoddService.Entry) string {
 	var messageText string
 
-	payload, err := PoddService.CreatePayload(user.Token, report.Id, time.Hour * 24 * 7)
+	payload, err := PoddService.CreatePayload(PoddService.ActionVerifyReport, user.Token, report.Id, time.Hour * 24 * 7)
 	if err == nil {
-		payloadStr, err := cipher.EncodePayload(payload)
+		payload.SetClaim(PoddService.ClaimReportType, strconv.Itoa(report.ReportTypeId))
+		locale := PoddService.SupportedLocale(user.Locale)
+		if locale != "" {
+			payload.SetClaim(PoddService.ClaimLocale, locale)
+		} else {
+			locale = PoddService.DefaultLocale
+		}
+
+		payloadStr, err := keyring.EncodePayload(payload)
 		if err != nil {
-			log.Printf("Error coding payload for user %s", user.Username)
-			log.Println(err)
+			logger.Error("Cannot encode payload", PoddService.Fields{"username": user.Username, "error": err})
 		} else {
-			messageText = fmt.Sprintf(gcmTemplate, report.FormDataExplanation, *verifyServerUrl + payloadStr)
+			PoddService.DefaultMetrics.LinksIssued.WithLabelValues(PoddService.ActionVerifyReport).Inc()
+			messageText, err = templates.Render(PoddService.TemplateGCMVerify, PoddService.GCMVerifyData{
+				FormDataExplanation: report.FormDataExplanation,
+				VerifyUrl: *verifyServerUrl + payloadStr,
+				Locale: locale,
+			})
+			if err != nil {
+				logger.Error("Cannot render message", PoddService.Fields{"username": user.Username, "error": err})
+			}
 		}
 	}
 
 	return messageText
 }
 
+// map PODD API response to callback result, 5xx is retryable
+func apiResult(resp *http.Response, expectedStatus int) PoddService.Result {
+	defer resp.Body.Close()
+
+	if resp.StatusCode == expectedStatus {
+		return PoddService.Result{}
+	}
+
+	err := fmt.Errorf("PODD API responded %s", resp.Status)
+	if resp.StatusCode >= 500 {
+		return PoddService.Retry(err)
+	}
+	return PoddService.Reject(http.StatusBadRequest, err)
+}
+
+// client of PODD API, a request gives up before its refNo stops pending so
+// a retry cannot submit a report twice
+func apiClient() *http.Client {
+	return &http.Client{Timeout: *poddAPITimeout}
+}
+
 type ZeroReportCallback struct{}
 
-func (c ZeroReportCallback) Execute(payload PoddService.Payload) (string, bool) {
-	client := &http.Client{}
+func (c ZeroReportCallback) Execute(payload PoddService.Payload) PoddService.Result {
+	client := apiClient()
 
 	date := time.Now().Local()
 	zeroReportJSON := fmt.Sprintf(zeroReport, date.Format("2006-01-02"), date.Format(time.RFC3339), date.Unix(), payload.RefNo)
@@ -121,47 +232,55 @@ func (c ZeroReportCallback) Execute(payload PoddService.Payload) (string, bool)
 	url := fmt.Sprintf("%s/reports/", *poddAPIURL)
 	req, err := http.NewRequest("POST", url, strings.NewReader(zeroReportJSON))
 	if err != nil {
-		fmt.Println(err)
+		return PoddService.Reject(http.StatusInternalServerError, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", "Token " + payload.Token)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Zero report error", err)
-		return "", false
+		return PoddService.Retry(err)
 	}
 
-	if resp.StatusCode == http.StatusCreated {
-		return ThankyouTemplate, true
-	} else {
-		return "", false
-	}
+	return apiResult(resp, http.StatusCreated)
 }
 
-type VerifyReportCallback struct{}
+// isVerified answers VerifyReportCallback understands, questionnaires must
+// offer exactly these
+var isVerifiedQuestion = PoddService.RequiredQuestion{Name: "isVerified", Values: []string{"1", "0"}}
 
-func (c VerifyReportCallback) Execute(payload PoddService.Payload) (string, bool) {
-	client := &http.Client{}
+type VerifyReportCallback struct {
+	Logger PoddService.Entry
+}
 
-	verified := "no"
-	println("Payload : isVerified", payload.Form.Get("isVerified"))
-	println("Payload : isOutbreak", payload.Form.Get("isOutbreak"))
+func (c VerifyReportCallback) Execute(payload PoddService.Payload) PoddService.Result {
+	client := apiClient()
 
-	if payload.Form.Get("isVerified") == "1" {
+	// never guess, a missing answer would mark a real report as a test
+	verified := ""
+	switch payload.Answers.Value("isVerified") {
+	case "1":
 		verified = "yes"
+	case "0":
+		verified = "no"
+	default:
+		return PoddService.Reject(http.StatusBadRequest, fmt.Errorf("report %d has no isVerified answer", payload.Id))
 	}
 
-	extraInfo := "สถานการณ์ไม่ลุกลาม"
-	if payload.Form.Get("isOutbreak") == "1" {
-		extraInfo = "สถานการณ์ลุกลาม"
+	// every other answer goes to extra info
+	infos := make([]string, 0, len(payload.Answers))
+	for _, answer := range payload.Answers {
+		if answer.Field.Name != "isVerified" {
+			infos = append(infos, answer.Info())
+		}
 	}
+	extraInfo := strings.Join(infos, ", ")
+	c.Logger.Info("Verify report", PoddService.Fields{"reportId": payload.Id, "verified": verified, "extraInfo": extraInfo})
 
 	targetUrl := fmt.Sprintf("%s/report/%d/protect-verify-case/%s/%s/", *poddAPIURL, payload.Id, *poddSharedKey, verified)
 	req, err := http.NewRequest("POST", targetUrl, nil)
 	if err != nil {
-		fmt.Println("Post to API error", err)
-		return "", false
+		return PoddService.Reject(http.StatusInternalServerError, err)
 	}
 
 	q := req.URL.Query()
@@ -170,15 +289,92 @@ func (c VerifyReportCallback) Execute(payload PoddService.Payload) (string, bool
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Verify error", err)
-		return "", false
+		return PoddService.Retry(err)
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		return ThankyouTemplate, true
-	} else {
-		return "", false
+	return apiResult(resp, http.StatusOK)
+}
+
+// VerifyReissuer pushes a fresh verify link while the report is still
+// waiting for verification.
+type VerifyReissuer struct {
+	DB           *sql.DB
+	Sender       PoddService.Sender
+	Keyring      PoddService.Keyring
+	Templates    *PoddService.Templates
+	// select expression of user locale, see localeSelect
+	LocaleSelect string
+	Logger       PoddService.Entry
+}
+
+// current report from PODD API
+func (v VerifyReissuer) report(payload PoddService.Payload) (Report, error) {
+	var report Report
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/reports/%d/", *poddAPIURL, payload.Id), nil)
+	if err != nil {
+		return report, err
+	}
+	req.Header.Add("Authorization", "Token " + payload.Token)
+
+	resp, err := apiClient().Do(req)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return report, fmt.Errorf("PODD API responded %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	return report, err
+}
+
+func (v VerifyReissuer) isOpen(report Report) bool {
+	return !report.TestFlag && report.StateCode == *acceptedReportStateCode
+}
+
+func (v VerifyReissuer) CanReissue(payload PoddService.Payload) (bool, error) {
+	if !payload.IsFor(PoddService.ActionVerifyReport) {
+		return false, nil
+	}
+
+	report, err := v.report(payload)
+	if err != nil {
+		return false, err
+	}
+	return v.isOpen(report), nil
+}
+
+func (v VerifyReissuer) Reissue(payload PoddService.Payload) error {
+	report, err := v.report(payload)
+	if err != nil {
+		return err
+	}
+	if !v.isOpen(report) {
+		return fmt.Errorf("report %d is no longer %s", report.Id, *acceptedReportStateCode)
 	}
+
+	user := User{Token: payload.Token, Device: Device{Type: DEVICE_TYPE_ANDROID}}
+	err = v.DB.QueryRow(`
+		SELECT u.username, gcm_reg_id, ` + v.LocaleSelect + `
+		FROM accounts_user u
+			 JOIN accounts_userdevice d on u.id = d.user_id
+			 JOIN authtoken_token t on u.id = t.user_id
+		WHERE t.key = $1 AND gcm_reg_id != ''
+	`, payload.Token).Scan(&user.Username, &user.Device.RegId, &user.Locale)
+	if err != nil {
+		return err
+	}
+
+	logger := v.Logger.With(PoddService.Fields{"reportId": report.Id})
+	messageText := createGCMMessageTextForUser(v.Keyring, v.Templates, &user, &report, logger)
+	if messageText == "" {
+		return fmt.Errorf("cannot create message of report %d", report.Id)
+	}
+
+	return PoddService.SendNotification(v.Sender, user.Device.RegId, messageText, logger)
 }
 
 type FormData struct {
@@ -199,110 +395,500 @@ type Report struct {
 	TestFlag                  bool     `json:"testFlag"`
 }
 
-func (r RedisCache) Exists(refNo string) bool {
-	// check redis key
-	value, err := r.Client.Do("EXISTS", refNo)
+func (r RedisCache) Ping() error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// unprefixed key of an older server, none when it cannot exist
+func (r RedisCache) legacyKey(key string) (string, bool) {
+	return key, r.Legacy && r.Prefix != ""
+}
+
+func (r RedisCache) Get(key string) (string, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	value, err := redis.String(conn.Do("GET", r.Prefix + key))
+	if legacy, ok := r.legacyKey(key); ok && err == redis.ErrNil {
+		value, err = redis.String(conn.Do("GET", legacy))
+	}
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return value, err
+}
+
+// set KEYS[1] unless it or the legacy KEYS[2] exists
+var claimLegacyScript = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+local set
+if tonumber(ARGV[2]) > 0 then
+	set = redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2])
+else
+	set = redis.call("SET", KEYS[1], ARGV[1], "NX")
+end
+if set then
+	return 1
+end
+return 0
+`)
+
+func (r RedisCache) Claim(key string, value string, ttl time.Duration) (bool, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	if legacy, ok := r.legacyKey(key); ok {
+		claimed, err := redis.Int(claimLegacyScript.Do(conn, r.Prefix + key, legacy, value, int64(ttl / time.Millisecond)))
+		return claimed == 1, err
+	}
+
+	var reply interface{}
+	var err error
+	if ttl > 0 {
+		reply, err = conn.Do("SET", r.Prefix + key, value, "NX", "PX", int64(ttl / time.Millisecond))
+	} else {
+		reply, err = conn.Do("SET", r.Prefix + key, value, "NX")
+	}
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 
-	return value == int64(1)
+	// nil reply when key already exists
+	return reply != nil, nil
+}
+
+var swapScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+func (r RedisCache) Swap(key string, old string, value string, ttl time.Duration) (bool, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	swapped, err := redis.Int(swapScript.Do(conn, r.Prefix + key, old, value, int64(ttl / time.Millisecond)))
+	return swapped == 1, err
 }
 
-func (r RedisCache) Set(key string, value string) error {
-	_, err := r.Client.Do("SET", key, value)
+func (r RedisCache) Delete(key string) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", r.Prefix + key)
 	return err
 }
 
-func doSubscribeReport(conn redis.Conn, db *sql.DB, sender PoddService.Sender) {
-	psc := redis.PubSubConn{conn}
-	psc.Subscribe("report:new")
+// RedisRateLimiter keeps token buckets in redis so servers share limits.
+type RedisRateLimiter struct {
+	Pool   *redis.Pool
+	Prefix string
+	Rate   PoddService.Rate
+}
 
-	for {
-		switch msg := psc.Receive().(type) {
-		case redis.Message:
-			log.Printf("%s: message: %s\n", msg.Channel, msg.Data)
+// bucket is a hash of tokens and last refill in ms, it expires once full again
+var tokenBucketScript = redis.NewScript(1, `
+local burst = tonumber(ARGV[1])
+local every = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / every)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * every)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], burst * every)
+return wait
+`)
 
-			dec := json.NewDecoder(strings.NewReader(string(msg.Data)))
+func (l RedisRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	conn := l.Pool.Get()
+	defer conn.Close()
 
-			var report Report
-			err := dec.Decode(&report)
-			if err != nil {
-				log.Fatal(err)
-			}
+	every := int64(l.Rate.Every / time.Millisecond)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	wait, err := redis.Int64(tokenBucketScript.Do(conn, l.Prefix + key, l.Rate.Burst, every, now))
+	if err != nil {
+		return false, 0, err
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
 
-			log.Println("Got new report")
-			log.Printf("  / reportId: %d, animalType: %s, stateCode: %s", report.Id, report.FormData.AnimalType, report.StateCode)
-
-			if !report.TestFlag &&
-				report.IsStateChanged &&
-				report.ParentId == 0 &&
-				report.ReportTypeId == *acceptedReportTypeId &&
-				report.StateCode == *acceptedReportStateCode {
-
-				// get gcm id
-				var username string
-				var gcmRegId string
-				var token string
-				rows, err := db.Query(`
-					SELECT u.username, gcm_reg_id, t.key
-					FROM accounts_user u
-						 JOIN accounts_userdevice d on u.id = d.user_id
-						 JOIN authtoken_token t on u.id = t.user_id
-					WHERE u.id = $1  AND gcm_reg_id != ''
-				`, report.CreatedById)
-				if err != nil {
-					log.Println("Error querying gcm reg id", err)
-					return
-				}
+func newRateLimiter(pool *redis.Pool, rate PoddService.Rate) PoddService.RateLimiter {
+	if rate.Burst <= 0 {
+		return nil
+	}
+	if *rateLimitRedisFlag {
+		return RedisRateLimiter{Pool: pool, Prefix: *rateLimitKeyPrefixFlag, Rate: rate}
+	}
+	return PoddService.NewMemoryRateLimiter(rate)
+}
 
-				rows.Next()
-				rows.Scan(&username, &gcmRegId, &token)
-				user := User{
-					Username: username,
-					Token: token,
-					Device: Device{
-						Type: DEVICE_TYPE_ANDROID,
-						RegId: gcmRegId,
-					},
-				}
+const auditSchema = `CREATE TABLE IF NOT EXISTS notify_audit (
+	id BIGSERIAL PRIMARY KEY,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	request_id VARCHAR(64) NOT NULL,
+	user_hash VARCHAR(32) NOT NULL,
+	report_id INTEGER NOT NULL,
+	action VARCHAR(64) NOT NULL,
+	ref_no VARCHAR(64) NOT NULL,
+	outcome VARCHAR(32) NOT NULL,
+	status_code INTEGER NOT NULL,
+	answers TEXT NOT NULL,
+	latency_ms DOUBLE PRECISION NOT NULL
+)`
 
-				if gcmRegId != "" {
-					log.Printf("  / -> Sending verify notification to user : %s (%d), device: %s\n", username, report.CreatedById, gcmRegId)
+// PostgresAuditSink inserts audit records into notify_audit from a
+// background worker so a slow database never holds up a response.
+type PostgresAuditSink struct {
+	DB      *sql.DB
+	Logger  *PoddService.Logger
+	records chan PoddService.AuditRecord
+	done    chan struct{}
 
-					gcmMessage := createGCMMessageTextForUser(&user, &report)
-					PoddService.SendNotification(sender, gcmRegId, gcmMessage)
-				}
-			} else {
-				log.Println("  / -> gonna ignore it")
-			}
-		case redis.Subscription:
-			log.Printf("%s: %s %d\n", msg.Channel, msg.Kind, msg.Count)
-		case error:
-			log.Println("Got new message and then error", msg.Error())
+	// Record after Close drops, handlers still running when the shutdown
+	// deadline passes must not send on the closed queue
+	lock    sync.Mutex
+	closed  bool
+	dropped int
+	// notify_audit is created by the first insert, so a database down at
+	// startup does not stop the server
+	created   bool
+	createErr error
+}
+
+func NewPostgresAuditSink(db *sql.DB, logger *PoddService.Logger, buffer int) *PostgresAuditSink {
+	sink := &PostgresAuditSink{
+		DB: db,
+		Logger: logger,
+		records: make(chan PoddService.AuditRecord, buffer),
+		done: make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+// Check fails until notify_audit could be created
+func (p *PostgresAuditSink) Check() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.created {
+		return nil
+	}
+	if p.createErr != nil {
+		return fmt.Errorf("cannot create notify_audit: %v", p.createErr)
+	}
+	return nil
+}
+
+// create notify_audit once, a failure is tried again by the next insert
+func (p *PostgresAuditSink) create() error {
+	p.lock.Lock()
+	created := p.created
+	p.lock.Unlock()
+	if created {
+		return nil
+	}
+
+	_, err := p.DB.Exec(auditSchema)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.created = err == nil
+	p.createErr = err
+	return err
+}
+
+// Record queues record, it is dropped when the queue is full or closed
+func (p *PostgresAuditSink) Record(record PoddService.AuditRecord) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		p.dropped++
+		return fmt.Errorf("audit sink is closed, dropped record of request %s", record.RequestId)
+	}
+	select {
+	case p.records <- record:
+		return nil
+	default:
+		return fmt.Errorf("audit queue is full, dropped record of request %s", record.RequestId)
+	}
+}
+
+func (p *PostgresAuditSink) run() {
+	defer close(p.done)
+	for record := range p.records {
+		if err := p.insert(record); err != nil {
+			p.Logger.With(PoddService.Fields{"requestId": record.RequestId}).Error("Cannot insert audit record", PoddService.Fields{"error": err})
 		}
 	}
 }
 
+// Close inserts queued records until ctx is done, records of later Record
+// calls are dropped
+func (p *PostgresAuditSink) Close(ctx context.Context) error {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.records)
+	}
+	p.lock.Unlock()
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return fmt.Errorf("dropped %d audit records: %v", len(p.records) + p.droppedCount(), ctx.Err())
+	}
+	if dropped := p.droppedCount(); dropped > 0 {
+		return fmt.Errorf("dropped %d audit records recorded after close", dropped)
+	}
+	return nil
+}
+
+func (p *PostgresAuditSink) droppedCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.dropped
+}
+
+func (p *PostgresAuditSink) insert(record PoddService.AuditRecord) error {
+	if err := p.create(); err != nil {
+		return err
+	}
+
+	answers, err := json.Marshal(record.Answers)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.DB.Exec(`INSERT INTO notify_audit
+		(time, request_id, user_hash, report_id, action, ref_no, outcome, status_code, answers, latency_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		record.Time, record.RequestId, record.UserHash, record.ReportId, record.Action, record.RefNo,
+		record.Outcome, record.StatusCode, string(answers), float64(record.Latency) / float64(time.Millisecond))
+	return err
+}
+
+var columnPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// select expression of user locale, the column is flag input so it is
+// checked to be a plain identifier before going into the query
+func localeSelect(column string) (string, error) {
+	if column == "" {
+		return "''", nil
+	}
+	if !columnPattern.MatchString(column) {
+		return "", fmt.Errorf("invalid locale column %q", column)
+	}
+	return "COALESCE(u." + column + ", '')", nil
+}
+
+// ReportNotifier sends a verify link to the reporter of a report:new
+// message of an accepted report.
+type ReportNotifier struct {
+	DB           *sql.DB
+	Sender       PoddService.Sender
+	Keyring      PoddService.Keyring
+	Templates    *PoddService.Templates
+	LocaleSelect string
+	Logger       PoddService.Entry
+}
+
+func (n ReportNotifier) Handle(channel string, data []byte) error {
+	n.Logger.Debug("Report message received", PoddService.Fields{"channel": channel, "message": string(data)})
+
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return ingest.UndecodableError{Err: err}
+	}
+
+	logger := n.Logger.With(PoddService.Fields{"reportId": report.Id})
+	logger.Info("Got new report", PoddService.Fields{"animalType": report.FormData.AnimalType, "stateCode": report.StateCode})
+
+	if report.TestFlag ||
+		!report.IsStateChanged ||
+		report.ParentId != 0 ||
+		report.ReportTypeId != *acceptedReportTypeId ||
+		report.StateCode != *acceptedReportStateCode {
+
+		logger.Debug("Report is ignored")
+		PoddService.DefaultMetrics.ReportMessages.WithLabelValues("filtered").Inc()
+		return nil
+	}
+
+	// get gcm id
+	var username string
+	var gcmRegId string
+	var token string
+	var locale string
+	rows, err := n.DB.Query(`
+		SELECT u.username, gcm_reg_id, t.key, ` + n.LocaleSelect + `
+		FROM accounts_user u
+			 JOIN accounts_userdevice d on u.id = d.user_id
+			 JOIN authtoken_token t on u.id = t.user_id
+		WHERE u.id = $1  AND gcm_reg_id != ''
+	`, report.CreatedById)
+	if err != nil {
+		return fmt.Errorf("cannot query gcm reg id: %v", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		rows.Scan(&username, &gcmRegId, &token, &locale)
+	}
+	user := User{
+		Username: username,
+		Token: token,
+		Locale: locale,
+		Device: Device{
+			Type: DEVICE_TYPE_ANDROID,
+			RegId: gcmRegId,
+		},
+	}
+
+	if gcmRegId != "" {
+		logger.Info("Sending verify notification", PoddService.Fields{"username": username, "userId": report.CreatedById, "regId": gcmRegId})
+
+		gcmMessage := createGCMMessageTextForUser(n.Keyring, n.Templates, &user, &report, logger)
+		// a stream entry stays pending and is delivered again
+		if err := PoddService.SendNotification(n.Sender, gcmRegId, gcmMessage, logger); err != nil {
+			return fmt.Errorf("cannot send verify notification of report %d: %v", report.Id, err)
+		}
+		PoddService.DefaultMetrics.ReportMessages.WithLabelValues("notified").Inc()
+	}
+	return nil
+}
+
+// ingester of ingest.mode
+func newIngester(pool *redis.Pool, handler ingest.MessageHandler, health *PoddService.SubscriberHealth, logger *PoddService.Logger) (ingest.Ingester, error) {
+	dial := func() (redis.Conn, error) {
+		return redis.Dial("tcp", fmt.Sprintf("%s:%d", *redisHostFlag, *redisPortFlag))
+	}
+	quarantine := ingest.RedisQuarantine{Pool: pool, Key: *quarantineKeyFlag, Max: *quarantineMaxFlag}
+
+	return ingest.New(pool, dial, ingest.Config{
+		Mode: *ingestModeFlag,
+		Stream: *streamKeyFlag,
+		Group: *streamGroupFlag,
+		Consumer: *streamConsumerFlag,
+		StartId: *streamStartIdFlag,
+		Block: *streamBlockFlag,
+		ClaimIdle: *streamClaimIdleFlag,
+		MaxDeliveries: *streamMaxDeliveriesFlag,
+		PingInterval: *subscriberPingIntervalFlag,
+		Backoff: PoddService.Backoff{Min: *subscriberBackoffMinFlag, Max: *subscriberBackoffMaxFlag},
+	}, handler, quarantine, health, logger)
+}
+
 func main() {
 	iniflags.Parse()
 
-	conn, err := redis.Dial("tcp", fmt.Sprintf("%s:%d", *redisHostFlag, *redisPortFlag))
+	logLevel, err := PoddService.ParseLevel(*logLevelFlag)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
+	logger := PoddService.NewLogger(os.Stderr, logLevel)
+
+	// a callback still waiting on PODD API when its refNo stops pending
+	// could submit alongside the retry
+	if *poddAPITimeout <= 0 || *poddAPITimeout >= *refNoPendingTimeoutFlag {
+		panic(fmt.Errorf("api.timeout %s must be above 0 and shorter than refNo.pendingTimeout %s", *poddAPITimeout, *refNoPendingTimeoutFlag))
+	}
+	// a callback cut off by shutdown leaves its refNo pending until
+	// refNo.pendingTimeout
+	if *poddAPITimeout >= *shutdownTimeoutFlag {
+		panic(fmt.Errorf("api.timeout %s must be shorter than shutdown.timeout %s", *poddAPITimeout, *shutdownTimeoutFlag))
+	}
+
+	redisPool := &redis.Pool{
+		MaxIdle: 10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", fmt.Sprintf("%s:%d", *redisHostFlag, *redisPortFlag))
+		},
+	}
+	defer redisPool.Close()
 
 	redisCache := RedisCache{
-		Client: conn,
+		Pool: redisPool,
+		Prefix: *redisKeyPrefixFlag,
+		Legacy: *redisLegacyKeysFlag,
 	}
 
+	// /readyz tells while redis is down
+	if err := redisCache.Ping(); err != nil {
+		log.Println("Cannot ping redis", err)
+	}
+
+	// links sent before the per-token nonce must keep working until they
+	// expire, an empty window would break every one of them on deploy
+	var legacyUntil time.Time
+	if *nonceFlag != "" && *nonceLegacyUntilFlag == "" {
+		panic(errors.New("nonce.legacyUntil is required while nonce is set, set it to the deploy date plus link lifetime or clear nonce to reject legacy tokens"))
+	}
+	if *nonceLegacyUntilFlag != "" {
+		legacyUntil, err = time.ParseInLocation("2006-01-02", *nonceLegacyUntilFlag, time.Local)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	keyring, err := newKeyring(legacyUntil)
+	if err != nil {
+		panic(err)
+	}
+
+	templates, err := PoddService.NewTemplates(*templatesDirFlag)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := templates.Reload(); err != nil {
+				log.Println("Cannot reload templates", err)
+			} else {
+				log.Println("Templates reloaded")
+			}
+		}
+	}()
+
 	server := PoddService.Server{
-		Cipher: PoddService.Cipher{
-			Key: *keyFlag,
-			Nonce: *nonceFlag,
-		},
+		Keyring: keyring,
 		Cache: redisCache,
+		Templates: templates,
+		RefNoGrace: *refNoGraceFlag,
+		RefNoPendingTimeout: *refNoPendingTimeoutFlag,
+		ReissueInterval: *reissueIntervalFlag,
+		CSRFKey: *csrfKeyFlag,
+		CSRFTTL: *csrfTTLFlag,
+		Logger: logger,
+	}
+	for _, origin := range strings.Split(*allowedOriginsFlag, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			server.AllowedOrigins = append(server.AllowedOrigins, origin)
+		}
 	}
 
 	db, err := sql.Open("postgres", *dbDSN)
@@ -310,23 +896,141 @@ func main() {
 		panic(err)
 	}
 	sender := PoddService.NewSender(*gcmAPIKey)
+	localeColumn, err := localeSelect(*dbLocaleColumnFlag)
+	if err != nil {
+		panic(err)
+	}
+
+	var audit *PostgresAuditSink
+	if *auditEnabledFlag {
+		audit = NewPostgresAuditSink(db, logger, *auditBufferFlag)
+		server.Audit = audit
+	}
+
+	server.Reissuer = VerifyReissuer{
+		DB: db,
+		Sender: sender,
+		Keyring: keyring,
+		Templates: templates,
+		LocaleSelect: localeColumn,
+		Logger: logger.With(PoddService.Fields{"component": "reissue"}),
+	}
+
+	subscriberHealth := &PoddService.SubscriberHealth{MaxSilence: *healthMaxSilenceFlag, MaxDown: *healthMaxDownFlag}
+	subscriber, err := newIngester(redisPool, ReportNotifier{
+		DB: db,
+		Sender: sender,
+		Keyring: keyring,
+		Templates: templates,
+		LocaleSelect: localeColumn,
+		Logger: logger.With(PoddService.Fields{"component": "notifier"}),
+	}, subscriberHealth, logger)
+	if err != nil {
+		panic(err)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-
 	go func() {
 		defer wg.Done()
-		conn, err := redis.Dial("tcp", fmt.Sprintf("%s:%d", *redisHostFlag, *redisPortFlag))
+		subscriber.Run()
+	}()
+
+	var draining int32
+
+	health := PoddService.Health{
+		Live: map[string]PoddService.Checker{
+			"subscriber": subscriberHealth.Live(),
+		},
+		Ready: map[string]PoddService.Checker{
+			"cache": server.CacheCheck(),
+			"db": PoddService.CheckFunc(db.Ping),
+			"subscriber": subscriberHealth,
+			"shutdown": PoddService.CheckFunc(func() error {
+				if atomic.LoadInt32(&draining) == 1 {
+					return errors.New("shutting down")
+				}
+				return nil
+			}),
+		},
+		Timeout: *healthTimeoutFlag,
+	}
+	if audit != nil {
+		health.Ready["audit"] = audit
+	}
+	if *healthAPIURLFlag != "" {
+		health.Ready["api"] = PoddService.HTTPCheck{URL: *healthAPIURLFlag, Client: &http.Client{Timeout: *healthTimeoutFlag}}
+	}
+
+	rateLimit := PoddService.RateLimit{
+		PerIP: newRateLimiter(redisPool, PoddService.Rate{Burst: *rateLimitIPBurstFlag, Every: *rateLimitIPEveryFlag}),
+		PerToken: newRateLimiter(redisPool, PoddService.Rate{Burst: *rateLimitTokenBurstFlag, Every: *rateLimitTokenEveryFlag}),
+		TrustForwardedFor: *trustForwardedForFlag,
+	}
+
+	http.HandleFunc("/report/zero/", server.WithRateLimit(rateLimit, server.ZeroReportHandler(ZeroReportCallback{})))
+	verifyAction := PoddService.VerifyReportAction(VerifyReportCallback{Logger: logger.With(PoddService.Fields{"component": "verify"})})
+	if *questionnairesFlag != "" {
+		// VerifyReportCallback rejects every answer without isVerified
+		verifyAction.Questionnaires, err = PoddService.LoadQuestionnaires(*questionnairesFlag, isVerifiedQuestion)
 		if err != nil {
 			panic(err)
 		}
-		defer conn.Close()
-		doSubscribeReport(conn, db, sender)
+	}
+	http.HandleFunc("/report/verify/", server.WithRateLimit(rateLimit, server.ActionHandler(verifyAction)))
+	http.HandleFunc("/token/", server.WithRateLimit(rateLimit, server.TokenStatusHandler()))
+	http.HandleFunc("/healthz", health.LiveHandler())
+	http.HandleFunc("/readyz", health.ReadyHandler())
+	if *metricsPathFlag != "" {
+		http.Handle(*metricsPathFlag, PoddService.DefaultMetrics.Handler())
+	}
+
+	httpServer := &http.Server{Addr: ":9800"}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- httpServer.ListenAndServe()
 	}()
 
-	http.HandleFunc("/report/zero/", server.ZeroReportHandler(ZeroReportCallback{}))
-	http.HandleFunc("/report/verify/", server.VerifyReportHandler(VerifyReportCallback{}))
-	http.ListenAndServe(":9800", nil)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		log.Println("Shutting down on", sig)
 
-	//wg.Wait()
+		// the load balancer sees /readyz fail and stops sending requests
+		// before the listener is closed
+		atomic.StoreInt32(&draining, 1)
+		time.Sleep(*shutdownDrainDelayFlag)
+	case err := <-listenErr:
+		log.Println("Cannot serve http", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+	defer cancel()
+
+	// new requests are refused, in-flight ones finish their callbacks
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Println("Cannot drain http requests", err)
+	}
+
+	// a report being notified is finished before the subscriber stops
+	subscriber.Stop()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("Subscriber did not stop in time")
+	}
+
+	if audit != nil {
+		if err := audit.Close(ctx); err != nil {
+			log.Println("Cannot drain audit records", err)
+		}
+	}
+	db.Close()
+	log.Println("Stopped")
 }
@@ -0,0 +1,188 @@
+package podd_service_notify
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate of a token bucket, it holds up to Burst requests and refills one
+// request per Every.
+type Rate struct {
+	Burst int
+	Every time.Duration
+}
+
+type RateLimiter interface {
+	// take one request from bucket of key, when the bucket is empty return
+	// false and how long until the next request is allowed
+	Allow(key string) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimiter keeps buckets of a single process.
+type MemoryRateLimiter struct {
+	Rate Rate
+
+	lock      sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimiter(rate Rate) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		Rate: rate,
+		buckets: make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// time an empty bucket takes to be full again
+func (r Rate) refill() time.Duration {
+	return time.Duration(r.Burst) * r.Every
+}
+
+func (m *MemoryRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(m.Rate.Burst), last: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(m.Rate.Burst), b.tokens + float64(now.Sub(b.last)) / float64(m.Rate.Every))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(m.Rate.Every)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// drop buckets which are full again, they are the same as missing ones
+func (m *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.Rate.refill() {
+		return
+	}
+
+	for key, b := range m.buckets {
+		if now.Sub(b.last) >= m.Rate.refill() {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+// RateLimit of requests to action handlers.
+type RateLimit struct {
+	// per client ip, nil means unlimited
+	PerIP RateLimiter
+	// per user token of the decoded payload, nil means unlimited
+	PerToken RateLimiter
+
+	// client ip is taken from the last X-Forwarded-For entry, only set
+	// behind a reverse proxy which appends it
+	TrustForwardedFor bool
+}
+
+type payloadContextKey struct{}
+
+// payload decoded by WithRateLimit, a bad token is decoded once
+type decodedPayload struct {
+	Payload Payload
+	Err     error
+}
+
+func (l RateLimit) clientIP(r *http.Request) string {
+	if l.TrustForwardedFor {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded) - 1]); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// a limiter failure lets the request through, the limit is a shield and
+// must not take the service down with it
+func allow(limiter RateLimiter, key string, logger Entry) (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+
+	ok, wait, err := limiter.Allow(key)
+	if err != nil {
+		logger.Error("Rate limiter error", Fields{"error": err})
+		return true, 0
+	}
+	return ok, wait
+}
+
+func (s Server) tooManyRequests(w http.ResponseWriter, r *http.Request, payload Payload, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	// a browser hides the 429 from a page of another origin without CORS
+	s.setCORS(w, r)
+
+	message := MessageIn(RequestLocale(payload, r), MessageTooManyRequests)
+	s.reply(w, r, http.StatusTooManyRequests, APIResponse{Status: StatusRateLimited, Message: message, Retryable: true}, message)
+}
+
+// WithRateLimit limits requests per client ip before the payload is decoded
+// and per user token after, the decoded payload is passed on to handler.
+// CORS preflights are not limited, handler answers them.
+func (s Server) WithRateLimit(limit RateLimit, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			handler(w, r)
+			return
+		}
+
+		r = withRequestId(w, r)
+		ip := limit.clientIP(r)
+		logger := s.requestLog(r).With(Fields{"ip": ip})
+		if ok, wait := allow(limit.PerIP, "ip:" + ip, logger); !ok {
+			logger.Warn("Rate limited ip")
+			s.tooManyRequests(w, r, Payload{}, wait)
+			return
+		}
+
+		payload, err := s.Keyring.DecodePayload(requestToken(r))
+		if err != nil {
+			// handler answers bad tokens
+			handler(w, r.WithContext(context.WithValue(r.Context(), payloadContextKey{}, decodedPayload{Err: err})))
+			return
+		}
+
+		if ok, wait := allow(limit.PerToken, "token:" + userKey(payload), logger); !ok {
+			logger.Warn("Rate limited token", Fields{"reportId": payload.Id, "user": userKey(payload)})
+			s.tooManyRequests(w, r, payload, wait)
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), payloadContextKey{}, decodedPayload{Payload: payload})))
+	}
+}
@@ -0,0 +1,157 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := NewMemoryRateLimiter(Rate{Burst: 2, Every: 50 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d within burst must be allowed", i)
+		}
+	}
+
+	ok, wait, _ := limiter.Allow("a")
+	if ok || wait <= 0 || wait > 50 * time.Millisecond {
+		t.Errorf("request over burst must wait for refill, got %t %v", ok, wait)
+	}
+	if ok, _, _ := limiter.Allow("b"); !ok {
+		t.Errorf("buckets must be separate per key")
+	}
+
+	time.Sleep(wait)
+	if ok, _, _ := limiter.Allow("a"); !ok {
+		t.Errorf("request must be allowed after refill")
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+	}
+
+	var count int32
+	handler := http.HandlerFunc(server.WithRateLimit(RateLimit{
+		PerIP: NewMemoryRateLimiter(Rate{Burst: 3, Every: time.Hour}),
+		PerToken: NewMemoryRateLimiter(Rate{Burst: 1, Every: time.Hour}),
+	}, server.ZeroReportHandler(CountingCallback{Count: &count})))
+
+	get := func(path string, remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	payload, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	if rr := get("/report/zero/" + payloadStr, "10.0.0.1:1234"); rr.Code != http.StatusOK || count != 1 {
+		t.Fatalf("first request must be handled, got %d", rr.Code)
+	}
+
+	// same user token from another ip
+	other, _ := CreatePayload(ActionZeroReport, "1234", 0, time.Second * 1000)
+	otherStr, _ := server.Keyring.EncodePayload(other)
+	rr := get("/report/zero/" + otherStr, "10.0.0.2:1234")
+	if rr.Code != http.StatusTooManyRequests || count != 1 {
+		t.Errorf("token over its limit must get 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("429 must tell when to retry")
+	}
+
+	// garbage tokens only cost the ip bucket
+	for i := 0; i < 2; i++ {
+		if rr := get("/report/zero/garbage", "10.0.0.1:1234"); rr.Code != http.StatusBadRequest {
+			t.Errorf("bad token within ip limit must reach handler, got %d", rr.Code)
+		}
+	}
+	if rr := get("/report/zero/garbage", "10.0.0.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("ip over its limit must get 429, got %d", rr.Code)
+	}
+	if rr := get("/report/zero/garbage", "10.0.0.3:1234"); rr.Code != http.StatusBadRequest {
+		t.Errorf("other ip must not be limited, got %d", rr.Code)
+	}
+}
+
+func TestWithRateLimitCORS(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: NewMemoryCache(),
+		AllowedOrigins: []string{"https://app.example.org"},
+	}
+	handler := http.HandlerFunc(server.WithRateLimit(RateLimit{
+		PerIP: NewMemoryRateLimiter(Rate{Burst: 1, Every: time.Hour}),
+	}, server.ZeroReportHandler(nil)))
+
+	request := func(method string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/report/zero/garbage", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Origin", "https://app.example.org")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// preflights do not cost the ip bucket
+	for i := 0; i < 2; i++ {
+		if rr := request("OPTIONS"); rr.Code != http.StatusNoContent {
+			t.Errorf("preflight must be answered, got %d", rr.Code)
+		}
+	}
+	if rr := request("GET"); rr.Code != http.StatusBadRequest {
+		t.Errorf("request within ip limit must reach handler, got %d", rr.Code)
+	}
+
+	rr := request("GET")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.org" {
+		t.Errorf("429 must be readable by an allowed origin, got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestWithRateLimitDecodesOnce(t *testing.T) {
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+	}
+
+	var decoded decodedPayload
+	handler := http.HandlerFunc(server.WithRateLimit(RateLimit{}, func(w http.ResponseWriter, r *http.Request) {
+		decoded, _ = r.Context().Value(payloadContextKey{}).(decodedPayload)
+		if _, err := server.decodeRequestPayload(r); err != decoded.Err {
+			t.Errorf("handler must get the error of the middleware, got %v want %v", err, decoded.Err)
+		}
+	}))
+
+	req, _ := http.NewRequest("GET", "/report/zero/garbage", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if decoded.Err == nil {
+		t.Errorf("decode error of a bad token must be passed on to handler")
+	}
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+	if ip := (RateLimit{}).clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("X-Forwarded-For must be ignored unless trusted, got %s", ip)
+	}
+	if ip := (RateLimit{TrustForwardedFor: true}).clientIP(req); ip != "5.6.7.8" {
+		t.Errorf("client ip must be the entry appended by the proxy, got %s", ip)
+	}
+}
@@ -0,0 +1,105 @@
+package podd_service_notify
+
+import (
+	"time"
+)
+
+// refNo states, committed is "1" so keys written before states existed
+// are still seen as processed
+const (
+	RefNoPending   = "pending"
+	RefNoCommitted = "1"
+	// callback failed, link can be retried
+	RefNoFailed = "failed"
+	// callback failed for good, link cannot be retried
+	RefNoRejected = "rejected"
+)
+
+// how long a refNo is kept after its payload expires
+const DefaultRefNoGrace = 24 * time.Hour
+
+// pending refNo of a request which died before finishing its callback
+// is released after this timeout
+const DefaultRefNoPendingTimeout = 2 * time.Minute
+
+// refNo only has to outlive its payload, expired payloads are rejected anyway
+func (s Server) refNoTTL(payload Payload) time.Duration {
+	grace := s.RefNoGrace
+	if grace == 0 {
+		grace = DefaultRefNoGrace
+	}
+
+	ttl := payload.Expire.Sub(time.Now()) + grace
+	if ttl < grace {
+		ttl = grace
+	}
+	return ttl
+}
+
+func (s Server) refNoPendingTimeout() time.Duration {
+	if s.RefNoPendingTimeout == 0 {
+		return DefaultRefNoPendingTimeout
+	}
+	return s.RefNoPendingTimeout
+}
+
+// ClaimRefNo marks a new or failed refNo as pending. Empty state is returned
+// when this call won the claim, otherwise the current state of refNo.
+func ClaimRefNo(cache RefNoCache, refNo string, pendingTimeout time.Duration) (string, error) {
+	claimed, err := cache.Claim(refNo, RefNoPending, pendingTimeout)
+	if err != nil || claimed {
+		return "", err
+	}
+
+	// retry of a failed callback
+	claimed, err = cache.Swap(refNo, RefNoFailed, RefNoPending, pendingTimeout)
+	if err != nil || claimed {
+		return "", err
+	}
+
+	state, err := cache.Get(refNo)
+	if err != nil {
+		return "", err
+	}
+	if state == "" {
+		// pending just timed out, try once more
+		return ClaimRefNo(cache, refNo, pendingTimeout)
+	}
+	return state, nil
+}
+
+func (s Server) claimRefNo(payload Payload) (string, error) {
+	return ClaimRefNo(s.Cache, payload.RefNo, s.refNoPendingTimeout())
+}
+
+// commitRefNo marks the pending refNo of this request as committed, a refNo
+// claimed by another request after its pending timed out is left alone
+func (s Server) commitRefNo(payload Payload) {
+	logger := s.logger().With(Fields{"refNo": payload.RefNo})
+	ttl := s.refNoTTL(payload)
+
+	committed, err := s.Cache.Swap(payload.RefNo, RefNoPending, RefNoCommitted, ttl)
+	if err == nil && !committed {
+		// pending timed out while the callback ran
+		committed, err = s.Cache.Claim(payload.RefNo, RefNoCommitted, ttl)
+	}
+	if err != nil {
+		logger.Error("Cannot commit refNo", Fields{"error": err})
+		return
+	}
+	if !committed {
+		state, _ := s.Cache.Get(payload.RefNo)
+		logger.Error("Cannot commit refNo, claimed by another request", Fields{"state": state})
+	}
+}
+
+func (s Server) failRefNo(payload Payload, retryable bool) {
+	state := RefNoRejected
+	if retryable {
+		state = RefNoFailed
+	}
+
+	if _, err := s.Cache.Swap(payload.RefNo, RefNoPending, state, s.refNoTTL(payload)); err != nil {
+		s.logger().With(Fields{"refNo": payload.RefNo}).Error("Cannot mark refNo", Fields{"state": state, "error": err})
+	}
+}
@@ -0,0 +1,115 @@
+package podd_service_notify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// a user can request one fresh link per interval
+const DefaultReissueInterval = time.Hour
+
+// Reissuer sends a fresh link for an expired one.
+type Reissuer interface {
+	// false when the report of payload no longer takes answers
+	CanReissue(payload Payload) (bool, error)
+	// mint a fresh link for payload and push it to the user's device
+	Reissue(payload Payload) error
+}
+
+func (s Server) reissueInterval() time.Duration {
+	if s.ReissueInterval == 0 {
+		return DefaultReissueInterval
+	}
+	return s.ReissueInterval
+}
+
+// the user token itself never goes into the cache
+func userKey(payload Payload) string {
+	sum := sha256.Sum256([]byte(payload.Token))
+	return hex.EncodeToString(sum[:16])
+}
+
+func reissueKey(payload Payload) string {
+	return "reissue:" + userKey(payload)
+}
+
+// true when expired page offers a fresh link
+func (s Server) canReissue(payload Payload) bool {
+	if s.Reissuer == nil {
+		return false
+	}
+
+	ok, err := s.Reissuer.CanReissue(payload)
+	if err != nil {
+		s.logger().With(Fields{"reportId": payload.Id}).Error("Cannot check whether link can be reissued", Fields{"error": err})
+	}
+	return ok
+}
+
+// handle request for a fresh link from expired page
+func (s Server) reissue(w http.ResponseWriter, r *http.Request, payload Payload, locale string) {
+	logger := s.requestLog(r).With(Fields{"reportId": payload.Id, "action": payload.ActionName()})
+	page := func(key string) string {
+		return s.renderPage(TemplateExpired, PageData{Payload: payload, Locale: locale, Message: MessageIn(locale, key)})
+	}
+
+	// a fresh link gets a new refNo, so a link answered or being answered
+	// must never be reissued
+	state, err := s.Cache.Get(payload.RefNo)
+	if err != nil {
+		logger.Error("Cannot get refNo", Fields{"error": err})
+		s.reply(w, r, http.StatusInternalServerError,
+			APIResponse{Status: StatusError, Message: MessageIn(locale, MessageTryAgain), Retryable: true},
+			page(MessageTryAgain))
+		return
+	}
+	if state != "" && state != RefNoFailed {
+		logger.Warn("Link is answered, not reissued", Fields{"state": state})
+		s.reply(w, r, http.StatusConflict,
+			APIResponse{Status: StatusAlreadyProcessed, Message: MessageIn(locale, MessageProcessed)},
+			page(MessageProcessed))
+		return
+	}
+
+	if !s.canReissue(payload) {
+		s.reply(w, r, http.StatusGone,
+			APIResponse{Status: StatusReportClosed, Message: MessageIn(locale, MessageReportClosed)},
+			page(MessageReportClosed))
+		return
+	}
+
+	claimed, err := s.Cache.Claim(reissueKey(payload), "1", s.reissueInterval())
+	if err != nil {
+		logger.Error("Cannot claim reissue", Fields{"error": err})
+		s.reply(w, r, http.StatusInternalServerError,
+			APIResponse{Status: StatusError, Message: MessageIn(locale, MessageTryAgain), Retryable: true},
+			page(MessageTryAgain))
+		return
+	}
+	if !claimed {
+		logger.Info("Reissue is rate limited")
+		s.reply(w, r, http.StatusTooManyRequests,
+			APIResponse{Status: StatusRateLimited, Message: MessageIn(locale, MessageReissueLimited)},
+			page(MessageReissueLimited))
+		return
+	}
+
+	if err := s.Reissuer.Reissue(payload); err != nil {
+		logger.Error("Cannot reissue link", Fields{"error": err})
+		// the user gets no link, so trying again must not be rate limited
+		if err := s.Cache.Delete(reissueKey(payload)); err != nil {
+			logger.Error("Cannot release reissue", Fields{"error": err})
+		}
+		s.reply(w, r, http.StatusBadGateway,
+			APIResponse{Status: StatusError, Message: MessageIn(locale, MessageTryAgain), Retryable: true},
+			page(MessageTryAgain))
+		return
+	}
+
+	logger.Info("Reissued link")
+	s.reply(w, r, http.StatusOK,
+		APIResponse{Status: StatusReissued, Message: MessageIn(locale, MessageReissued)},
+		page(MessageReissued))
+}
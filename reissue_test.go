@@ -0,0 +1,172 @@
+package podd_service_notify
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type RecordingReissuer struct {
+	Open     bool
+	Err      error
+	Reissued *[]Payload
+}
+
+func (r RecordingReissuer) CanReissue(payload Payload) (bool, error) {
+	return r.Open, nil
+}
+
+func (r RecordingReissuer) Reissue(payload Payload) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	*r.Reissued = append(*r.Reissued, payload)
+	return nil
+}
+
+func requestReissue(handler http.Handler, server Server, payload Payload) *httptest.ResponseRecorder {
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	req, _ := http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "reissue=1")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestExpiredLinkReissue(t *testing.T) {
+	reissued := make([]Payload, 0)
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache:    NewMemoryCache(),
+		Reissuer: RecordingReissuer{Open: true, Reissued: &reissued},
+	}
+	handler := http.HandlerFunc(server.VerifyReportHandler(nil))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -time.Second)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `name="reissue"`) {
+		t.Errorf("expired page of an open report must offer a fresh link")
+	}
+
+	rr = requestReissue(handler, server, payload)
+	if rr.Code != http.StatusOK || len(reissued) != 1 || reissued[0].Id != 1234 {
+		t.Errorf("fresh link must be reissued, got %d, %d reissued", rr.Code, len(reissued))
+	}
+	if !strings.Contains(rr.Body.String(), Message(MessageReissued)) {
+		t.Errorf("page must tell the link is sent")
+	}
+
+	// another expired link of the same user
+	other, _ := CreatePayload(ActionVerifyReport, "1234", 5678, -time.Second)
+	rr = requestReissue(handler, server, other)
+	if rr.Code != http.StatusTooManyRequests || len(reissued) != 1 {
+		t.Errorf("reissue must be rate limited per user, got %d", rr.Code)
+	}
+
+	otherUser, _ := CreatePayload(ActionVerifyReport, "5678", 1234, -time.Second)
+	if rr = requestReissue(handler, server, otherUser); rr.Code != http.StatusOK || len(reissued) != 2 {
+		t.Errorf("rate limit must not apply to other users, got %d", rr.Code)
+	}
+}
+
+func TestExpiredLinkReissueClosedReport(t *testing.T) {
+	reissued := make([]Payload, 0)
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache:    NewMemoryCache(),
+		Reissuer: RecordingReissuer{Open: false, Reissued: &reissued},
+	}
+	handler := http.HandlerFunc(server.VerifyReportHandler(nil))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -time.Second)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), `name="reissue"`) {
+		t.Errorf("expired page of a closed report must not offer a fresh link")
+	}
+
+	if rr = requestReissue(handler, server, payload); rr.Code != http.StatusGone || len(reissued) != 0 {
+		t.Errorf("closed report must not be reissued, got %d", rr.Code)
+	}
+
+	server.Reissuer = RecordingReissuer{Open: true, Err: errors.New("no device")}
+	handler = http.HandlerFunc(server.VerifyReportHandler(nil))
+	if rr = requestReissue(handler, server, payload); rr.Code != http.StatusBadGateway {
+		t.Errorf("failed push must be reported, got %d", rr.Code)
+	}
+}
+
+func TestExpiredLinkReissueFailedPush(t *testing.T) {
+	reissued := make([]Payload, 0)
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache:    NewMemoryCache(),
+		Reissuer: RecordingReissuer{Open: true, Err: errors.New("GCM is down"), Reissued: &reissued},
+	}
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -time.Second)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	handler := http.HandlerFunc(server.VerifyReportHandler(nil))
+	code, response := serveJSON(handler, "POST", "/report/verify/" + payloadStr, `{"csrf": "` + csrfToken(server, payload) + `", "reissue": 1}`)
+	if code != http.StatusBadGateway || !response.Retryable {
+		t.Errorf("failed push must be retryable, got %d %v", code, response)
+	}
+
+	// the failed push must not count against the interval
+	server.Reissuer = RecordingReissuer{Open: true, Reissued: &reissued}
+	handler = http.HandlerFunc(server.VerifyReportHandler(nil))
+	if rr := requestReissue(handler, server, payload); rr.Code != http.StatusOK || len(reissued) != 1 {
+		t.Errorf("retry after failed push must be reissued, got %d", rr.Code)
+	}
+}
+
+func TestExpiredLinkReissueAnswered(t *testing.T) {
+	reissued := make([]Payload, 0)
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache:    cache,
+		Reissuer: RecordingReissuer{Open: true, Reissued: &reissued},
+	}
+	handler := http.HandlerFunc(server.VerifyReportHandler(nil))
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, -time.Second)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+	cache.Set(payload.RefNo, RefNoCommitted, 0)
+
+	req, _ := http.NewRequest("GET", "/report/verify/" + payloadStr, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), `name="reissue"`) {
+		t.Errorf("expired page of an answered link must tell it is processed, got %d", rr.Code)
+	}
+
+	if rr = requestReissue(handler, server, payload); len(reissued) != 0 || !strings.Contains(rr.Body.String(), Message(MessageProcessed)) {
+		t.Errorf("answered link must not be reissued, got %d", rr.Code)
+	}
+
+	// answered while the expired page was open
+	rr = httptest.NewRecorder()
+	server.reissue(rr, httptest.NewRequest("POST", "/report/verify/" + payloadStr, nil), payload, "th")
+	if rr.Code != http.StatusConflict || len(reissued) != 0 {
+		t.Errorf("reissue must refuse an answered link, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,67 @@
+package podd_service_notify
+
+import (
+	"net/http"
+)
+
+// Result of Callback.Execute
+type Result struct {
+	// http status, 0 means 200 on success and 500 on error
+	Status int
+	// rendered body, takes precedence over MessageKey
+	Body string
+	// key of Messages shown to the user
+	MessageKey string
+
+	Err error
+	// the user may retry the same link after a failed callback
+	Retryable bool
+}
+
+func Done(body string) Result {
+	return Result{Body: body}
+}
+
+// failure the user can retry, e.g. PODD API is down
+func Retry(err error) Result {
+	return Result{
+		Status: http.StatusBadGateway,
+		MessageKey: MessageTryAgain,
+		Err: err,
+		Retryable: true,
+	}
+}
+
+// failure which fails again on retry, the link is burned
+func Reject(status int, err error) Result {
+	return Result{
+		Status: status,
+		MessageKey: MessageRejected,
+		Err: err,
+	}
+}
+
+func (r Result) Success() bool {
+	return r.Err == nil
+}
+
+func (r Result) StatusCode() int {
+	if r.Status != 0 {
+		return r.Status
+	}
+	if r.Success() {
+		return http.StatusOK
+	}
+	return http.StatusInternalServerError
+}
+
+// body or message of MessageKey in locale, fallback when both are empty
+func (r Result) Render(locale string, fallback string) string {
+	if r.Body != "" {
+		return r.Body
+	}
+	if r.MessageKey != "" {
+		return MessageIn(locale, r.MessageKey)
+	}
+	return fallback
+}
@@ -1,10 +1,10 @@
 package podd_service_notify
 
 import (
+	"fmt"
 	"github.com/alexjlockwood/gcm"
 	"net/http"
 	"strconv"
-	"log"
 	"math/rand"
 )
 
@@ -44,7 +44,9 @@ func (s *TestSender) Send(msg *gcm.Message, retries int) (*gcm.Response, error)
 	}, nil
 }
 
-func SendNotification(sender Sender, regId string, messageText string) {
+// SendNotification pushes messageText to regId, the error tells the
+// message was not delivered so the caller can try again.
+func SendNotification(sender Sender, regId string, messageText string, logger Entry) error {
 	messageId := strconv.Itoa(rand.Int())
 
 	successCount := 0
@@ -63,8 +65,9 @@ func SendNotification(sender Sender, regId string, messageText string) {
 	message.TimeToLive = 604800 // 60 * 60 * 24 * 7
 
 	response, err := sender.Send(message, 3)
+	DefaultMetrics.ObserveSend(response, err, len(regIds))
 	if err != nil {
-		log.Print("Fail with error ", err, response)
+		logger.Error("Cannot send GCM message", Fields{"error": err})
 
 		if response != nil {
 			failCount += response.Failure
@@ -73,7 +76,16 @@ func SendNotification(sender Sender, regId string, messageText string) {
 		}
 	} else {
 		successCount += response.Success
+		failCount += response.Failure
 	}
 
-	log.Printf("Successfully sent GCM messages to %d devices, fail %d devices", successCount, failCount)
+	logger.Info("GCM messages sent", Fields{"success": successCount, "failure": failCount})
+
+	if err != nil {
+		return err
+	}
+	if failCount > 0 {
+		return fmt.Errorf("GCM failed to deliver to %d devices", failCount)
+	}
+	return nil
 }
\ No newline at end of file
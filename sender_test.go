@@ -0,0 +1,29 @@
+package podd_service_notify
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alexjlockwood/gcm"
+)
+
+type FailingSender struct {
+	Response *gcm.Response
+	Err      error
+}
+
+func (s FailingSender) Send(msg *gcm.Message, retries int) (*gcm.Response, error) {
+	return s.Response, s.Err
+}
+
+func TestSendNotification(t *testing.T) {
+	if err := SendNotification(&TestSender{}, "reg-id", "message", DefaultLogger.With(nil)); err != nil {
+		t.Errorf("delivered message must not fail, got %v", err)
+	}
+	if err := SendNotification(FailingSender{Err: errors.New("unavailable")}, "reg-id", "message", DefaultLogger.With(nil)); err == nil {
+		t.Errorf("send error must be returned")
+	}
+	if err := SendNotification(FailingSender{Response: &gcm.Response{Failure: 1}}, "reg-id", "message", DefaultLogger.With(nil)); err == nil {
+		t.Errorf("undelivered device must be returned as error")
+	}
+}
@@ -0,0 +1,74 @@
+package podd_service_notify
+
+import (
+	"net/http"
+	"time"
+)
+
+// body of TokenStatusHandler
+type TokenStatus struct {
+	Status string `json:"status"`
+
+	Action    string     `json:"action,omitempty"`
+	ReportId  int        `json:"reportId,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Expired   bool       `json:"expired"`
+
+	// pending, committed, failed or rejected, empty when the link was never submitted
+	State string `json:"state,omitempty"`
+	// committed or rejected, submitting again does nothing
+	Consumed bool `json:"consumed"`
+	// link can still be submitted
+	Actionable bool `json:"actionable"`
+}
+
+// RefNoCommitted predates named states
+func refNoStateName(state string) string {
+	if state == RefNoCommitted {
+		return "committed"
+	}
+	return state
+}
+
+// TokenStatusHandler tells whether a link is still actionable, the refNo is
+// only read so the link stays usable.
+func (s Server) TokenStatusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.setCORS(w, r) {
+			return
+		}
+
+		r = withRequestId(w, r)
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, err := s.decodeRequestPayload(r)
+		if err != nil {
+			s.requestLog(r).Warn("Cannot decode payload", Fields{"error": err})
+			s.writeJSON(w, http.StatusBadRequest, TokenStatus{Status: StatusInvalidToken})
+			return
+		}
+
+		state, err := s.Cache.Get(payload.RefNo)
+		if err != nil {
+			s.requestLog(r).Error("Cannot get refNo", Fields{"reportId": payload.Id, "error": err})
+			s.writeJSON(w, http.StatusInternalServerError, TokenStatus{Status: StatusError})
+			return
+		}
+
+		expire := payload.Expire.UTC()
+		status := TokenStatus{
+			Status: StatusOK,
+			Action: payload.ActionName(),
+			ReportId: payload.Id,
+			ExpiresAt: &expire,
+			Expired: payload.IsExpired(),
+			State: refNoStateName(state),
+			Consumed: state == RefNoCommitted || state == RefNoRejected,
+		}
+		status.Actionable = !status.Expired && !status.Consumed
+		s.writeJSON(w, http.StatusOK, status)
+	}
+}
@@ -0,0 +1,65 @@
+package podd_service_notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTokenStatus(server Server, payloadStr string) (int, TokenStatus) {
+	req, _ := http.NewRequest("GET", "/token/" + payloadStr + "/status", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.TokenStatusHandler()).ServeHTTP(rr, req)
+
+	var status TokenStatus
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	return rr.Code, status
+}
+
+func TestTokenStatusHandler(t *testing.T) {
+	cache := NewMemoryCache()
+	server := Server{
+		Keyring: NewKeyring("1", Cipher{
+			Key: "1234567890123456",
+		}),
+		Cache: cache,
+	}
+
+	code, status := getTokenStatus(server, "nothex")
+	if code != http.StatusBadRequest || status.Status != StatusInvalidToken {
+		t.Errorf("bad token: got %d %q", code, status.Status)
+	}
+
+	payload, _ := CreatePayload(ActionVerifyReport, "1234", 1234, time.Second * 1000)
+	payloadStr, _ := server.Keyring.EncodePayload(payload)
+
+	code, status = getTokenStatus(server, payloadStr)
+	if code != http.StatusOK || status.Action != ActionVerifyReport || status.ReportId != 1234 || !status.Actionable || status.Consumed {
+		t.Errorf("fresh token must be actionable, got %d %+v", code, status)
+	}
+	if status.ExpiresAt == nil || status.ExpiresAt.Unix() != payload.Expire.Unix() {
+		t.Errorf("expiry must be of payload, got %v", status.ExpiresAt)
+	}
+	if state, _ := cache.Get(payload.RefNo); state != "" {
+		t.Errorf("status must not claim refNo, got %q", state)
+	}
+
+	req, _ := http.NewRequest("POST", "/report/verify/" + payloadStr, strings.NewReader(withCSRF(server, payload, "isVerified=1&isOutbreak=0")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	http.HandlerFunc(server.VerifyReportHandler(nil)).ServeHTTP(httptest.NewRecorder(), req)
+
+	_, status = getTokenStatus(server, payloadStr)
+	if status.State != "committed" || !status.Consumed || status.Actionable {
+		t.Errorf("submitted token must be consumed, got %+v", status)
+	}
+
+	expired, _ := CreatePayload(ActionZeroReport, "1234", 0, -time.Second)
+	expiredStr, _ := server.Keyring.EncodePayload(expired)
+	_, status = getTokenStatus(server, expiredStr)
+	if !status.Expired || status.Actionable || status.Action != ActionZeroReport {
+		t.Errorf("expired token must not be actionable, got %+v", status)
+	}
+}
@@ -0,0 +1,147 @@
+package podd_service_notify
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sync"
+)
+
+// template names, a file of the same name in templates dir overrides the default
+const (
+	TemplateQuestionnaire  = "questionnaire.html"
+	TemplateVerifyDone     = "verify_thankyou.html"
+	TemplateZeroReportDone = "zero_report_thankyou.html"
+	TemplateExpired        = "expired.html"
+	TemplateProcessed      = "processed.html"
+	TemplateGCMVerify      = "gcm_verify.html"
+)
+
+// data of action pages
+type PageData struct {
+	Payload Payload
+	Form    Form
+	// locale of messages and labels, DefaultLocale when empty
+	Locale string
+
+	// of a rejected submit, error message keys by field name
+	Errors map[string]string
+	Values url.Values
+
+	// localized notice of the page, e.g. outcome of a reissue request
+	Message string
+	// expired page offers a fresh link
+	Reissuable bool
+	// token of CSRFField, every rendered form has its own
+	CSRF string
+}
+
+// data of TemplateGCMVerify
+type GCMVerifyData struct {
+	FormDataExplanation string
+	VerifyUrl           string
+	Locale              string
+}
+
+var templateFuncs = template.FuncMap{
+	"inc": func(i int) int {
+		return i + 1
+	},
+	"message": Message,
+	// message of key in locale
+	"t": MessageIn,
+	// submitted value of field
+	"value": func(values url.Values, name string) string {
+		return values.Get(name)
+	},
+	// true when value of field is submitted
+	"has": func(values url.Values, name string, value string) bool {
+		for _, v := range values[name] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+type Templates struct {
+	// *.html files here override embedded defaults, empty means defaults only
+	Dir string
+
+	lock sync.RWMutex
+	set  *template.Template
+}
+
+func NewTemplates(dir string) (*Templates, error) {
+	t := &Templates{Dir: dir}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var defaultTemplateSet *Templates
+var defaultTemplateOnce sync.Once
+
+func DefaultTemplates() *Templates {
+	defaultTemplateOnce.Do(func() {
+		t, err := NewTemplates("")
+		if err != nil {
+			panic(err)
+		}
+		defaultTemplateSet = t
+	})
+	return defaultTemplateSet
+}
+
+// re-read templates dir, so wording can change without a redeploy
+func (t *Templates) Reload() error {
+	texts := make(map[string]string)
+	for name, text := range defaultTemplates {
+		texts[name] = text
+	}
+
+	if t.Dir != "" {
+		files, err := filepath.Glob(filepath.Join(t.Dir, "*.html"))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			text, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			texts[filepath.Base(file)] = string(text)
+		}
+	}
+
+	set := template.New("").Funcs(templateFuncs)
+	for name, text := range texts {
+		if _, err := set.New(name).Parse(text); err != nil {
+			return fmt.Errorf("template %s: %v", name, err)
+		}
+	}
+
+	t.lock.Lock()
+	t.set = set
+	t.lock.Unlock()
+
+	return nil
+}
+
+func (t *Templates) Render(name string, data interface{}) (string, error) {
+	t.lock.RLock()
+	set := t.set
+	t.lock.RUnlock()
+
+	var buf bytes.Buffer
+	if err := set.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
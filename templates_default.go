@@ -0,0 +1,82 @@
+package podd_service_notify
+
+// embedded defaults of Templates
+var defaultTemplates = map[string]string{
+	"style.html": `
+<style>
+body {
+    font-family: sans-serif;
+    font-size: 20px;
+    line-height: 1.5em;
+    padding: 5px;
+}
+.hide {
+	display: none;
+}
+.error { color: #e00; }
+</style>
+`,
+
+	// data is PageData with Form
+	TemplateQuestionnaire: `{{template "style.html"}}
+<form method="POST" type="application/x-www-form-urlencoded">
+<input type="hidden" name="reportId" value="{{.Payload.Id}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{with .Message}}<p class="error">{{.}}</p>{{end}}
+{{if .Errors}}<p class="error">{{t $.Locale "invalid_form"}}</p>{{end}}
+{{range $i, $field := .Form.Fields}}
+<p>{{inc $i}}. {{$field.LabelIn $.Locale}}</p>
+<div style="padding: 10px;border: 1px solid #ccc;background-color: #f5f5f5;">
+  {{if or (eq $field.Type "radio") (eq $field.Type "checkbox")}}
+  {{range $j, $option := $field.Options}}
+  <input type="{{$field.Type}}" id="{{$field.Name}}-{{$j}}" name="{{$field.Name}}" value="{{$option.Value}}" {{if and $field.Required (eq $field.Type "radio")}}required{{end}} {{if has $.Values $field.Name $option.Value}}checked{{end}} style="margin-right:10px;line-height:45px;"><label for="{{$field.Name}}-{{$j}}" style="line-height:45px;">{{$option.LabelIn $.Locale}}</label><br/>
+  {{end}}
+  {{else if eq $field.Type "number"}}
+  <input type="number" step="any" name="{{$field.Name}}" value="{{value $.Values $field.Name}}" {{if $field.Required}}required{{end}} style="font-size: 18px;padding: 5px;">
+  {{else}}
+  <input type="text" name="{{$field.Name}}" value="{{value $.Values $field.Name}}" {{if $field.Required}}required{{end}} style="font-size: 18px;padding: 5px;width: 90%;">
+  {{end}}
+  {{with index $.Errors $field.Name}}<div class="error" id="error-{{$field.Name}}">{{t $.Locale .}}</div>{{end}}
+</div>
+{{end}}
+<button style="border:none;padding: 10px;color: #fff;margin: 15px 0 0;font-size: 18px;background-color: #1C95EF;">{{t .Locale "submit"}}</button>
+</form>
+`,
+
+	TemplateVerifyDone: `{{template "style.html"}}
+<p>{{t .Locale "verify_thankyou"}}</p>
+`,
+
+	TemplateZeroReportDone: `{{t .Locale "zero_report_thankyou"}}`,
+
+	// data is PageData with Message after a reissue request
+	TemplateExpired: `{{template "style.html"}}
+<p>{{t .Locale "expired"}}</p>
+{{with .Message}}<p>{{.}}</p>{{end}}
+{{if .Reissuable}}
+<form method="POST" type="application/x-www-form-urlencoded">
+<input type="hidden" name="reissue" value="1">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<button style="border:none;padding: 10px;color: #fff;margin: 15px 0 0;font-size: 18px;background-color: #1C95EF;">{{t .Locale "reissue"}}</button>
+</form>
+{{end}}
+`,
+
+	TemplateProcessed: `{{template "style.html"}}
+<p>{{t .Locale "processed"}}</p>
+`,
+
+	// data is GCMVerifyData
+	TemplateGCMVerify: `
+<p>{{t .Locale "gcm_verify_reported"}} {{.FormDataExplanation}}</p>
+<p>
+	<strong><u>{{t .Locale "gcm_verify_request"}}</u></strong>
+	{{t .Locale "gcm_verify_note"}}
+</p>
+
+<hr style= "border:none;border-top: 1px solid #ccc;"/>
+
+<iframe src="{{.VerifyUrl}}" frameborder="0" scrolling="no" width="100%" height="600px">
+</iframe>
+`,
+}
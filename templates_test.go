@@ -0,0 +1,66 @@
+package podd_service_notify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderVerifyFormReportId(t *testing.T) {
+	page, err := DefaultTemplates().Render(TemplateQuestionnaire, PageData{Payload: Payload{Id: 160831}, Form: DefaultVerifyForm})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(page, `name="reportId" value="160831"`) {
+		t.Errorf("verify form must contain report id of payload")
+	}
+}
+
+func TestTemplatesOverrideAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, TemplateExpired)
+	ioutil.WriteFile(file, []byte(`expired {{.Payload.Id}}`), 0644)
+
+	templates, err := NewTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, _ := templates.Render(TemplateExpired, PageData{Payload: Payload{Id: 1}})
+	if page != "expired 1" {
+		t.Errorf("template must be overridden by templates dir, got %q", page)
+	}
+
+	// not overridden
+	if _, err := templates.Render(TemplateVerifyDone, PageData{}); err != nil {
+		t.Errorf("default template must be kept, %v", err)
+	}
+
+	ioutil.WriteFile(file, []byte(`link {{.Payload.Id}} expired`), 0644)
+	if err := templates.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	page, _ = templates.Render(TemplateExpired, PageData{Payload: Payload{Id: 1}})
+	if page != "link 1 expired" {
+		t.Errorf("template must be reloaded, got %q", page)
+	}
+
+	ioutil.WriteFile(file, []byte(`{{.Broken`), 0644)
+	if err := templates.Reload(); err == nil {
+		t.Errorf("broken template must fail reload")
+	}
+
+	page, _ = templates.Render(TemplateExpired, PageData{Payload: Payload{Id: 1}})
+	if page != "link 1 expired" {
+		t.Errorf("failed reload must keep previous templates, got %q", page)
+	}
+}